@@ -1,20 +1,27 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"strconv"
 
 	"github.com/alecthomas/kong"
 	"github.com/toastate/toastfront/internal/tlogger"
+	"github.com/toastate/toastfront/internal/watcher"
 	"github.com/toastate/toastfront/pkg/builder"
 	"github.com/toastate/toastfront/pkg/config"
+	"github.com/toastate/toastfront/pkg/scaffold"
 	"github.com/toastate/toastfront/pkg/server"
 )
 
 var CLI struct {
-	Build CommandBuild `cmd:"" aliases:"b" help:"Builds or rebuilds the project."`
-	Serve CommandServe `cmd:"" aliases:"s" help:"Run a live dev server."`
+	Build  CommandBuild  `cmd:"" aliases:"b" help:"Builds or rebuilds the project."`
+	Serve  CommandServe  `cmd:"" aliases:"s" help:"Run a live dev server."`
+	Init   CommandInit   `cmd:"" help:"Create a new project skeleton."`
+	Config CommandConfig `cmd:"" help:"Configuration file helpers."`
+	I18n   CommandI18n   `cmd:"" name:"i18n" help:"Translation helpers."`
 
 	ConfigFile string `short:"c" help:"configuration file path (optional)"`
 }
@@ -26,6 +33,15 @@ type CommandBuild struct {
 	UnsetEnv []string          `short:"u" help:"helper to unset environment variables from the process"`
 	ClearEnv bool              `short:"c" help:"helper to clear all environment variable from the process"`
 
+	Minify     bool     `short:"m" help:"Minify HTML, CSS and JS outputs."`
+	MinifySkip []string `help:"Output types left unminified (html, css, js)." enum:"html,css,js"`
+	HashAssets bool     `help:"Add a content hash to JS, CSS and asset file names and write asset-manifest.json."`
+	SourceMaps bool     `help:"Write source maps for the JS and CSS outputs."`
+	Jobs       int      `short:"j" help:"Number of files built concurrently (defaults to the number of CPUs)."`
+	Sitemap    bool     `help:"Write sitemap.xml, listing the alternate languages of every page."`
+	StrictI18n bool     `name:"strict-i18n" help:"Fail the build on missing translation keys or undefined vars."`
+	KeepGoing  bool     `short:"k" help:"Build every file after an error to report all of them, the build still fails."`
+
 	Verbose int `short:"v" help:"Print verbose output." type:"counter"`
 }
 
@@ -34,23 +50,56 @@ type CommandServe struct {
 	BuildDir string `help:"Build output."`
 	Build    bool   `negatable:"" help:"Don't run build."`
 
+	SourceMaps bool `help:"Write source maps for the JS and CSS outputs."`
+	Poll       bool `help:"Poll the source directory for changes, for filesystems without change events (network shares, some containers)."`
+	InMemory   bool `help:"Keep the build in memory and serve the last successful one, the build directory is left untouched."`
+
 	Port int `short:"p" help:"Listener port"`
 
 	Verbose int `short:"v" help:"Print verbose output." type:"counter"`
 }
 
+type CommandInit struct {
+	Dir          string   `arg:"" optional:"" help:"Project directory (defaults to the current directory)."`
+	Languages    []string `short:"l" help:"Languages of the site."`
+	RootLanguage string   `help:"Language served at the root of the site (defaults to the first language)."`
+	HTMLDir      string   `help:"HTML directory, relative to the source directory."`
+
+	Verbose int `short:"v" help:"Print verbose output." type:"counter"`
+}
+
+type CommandConfig struct {
+	Check CommandConfigCheck `cmd:"" help:"Validate the configuration file without building."`
+}
+
+type CommandConfigCheck struct {
+	SrcDir string `help:"Source directory (defaults to the configured one)."`
+}
+
+type CommandI18n struct {
+	Check CommandI18nCheck `cmd:"" help:"Report missing translation keys and undefined vars."`
+}
+
+type CommandI18nCheck struct {
+	SrcDir string `help:"Source directory." type:"existingdir"`
+	Strict bool   `help:"Fail on warnings too."`
+
+	Verbose int `short:"v" help:"Print verbose output." type:"counter"`
+}
+
 func main() {
 	ctx := kong.Parse(&CLI, kong.UsageOnError())
 
-	err := config.Init(CLI.ConfigFile)
-	if err != nil {
-		log.Fatal(err)
+	// config check reports the configuration issues itself
+	if ctx.Command() != "config check" {
+		err := config.Init(CLI.ConfigFile)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	err = ctx.Run(ctx)
-	if err != nil {
-		ctx.PrintUsage(false)
-	}
+	err := ctx.Run(ctx)
+	ctx.FatalIfErrorf(err)
 }
 
 func applyVerbose(v int) {
@@ -99,8 +148,40 @@ func (r *CommandBuild) Run(ctx *kong.Context) error {
 		return err
 	}
 
-	err = buildtool.Build(&builder.BuilderOpts{})
+	err = buildtool.Build(&builder.BuilderOpts{
+		Minify:     r.Minify || config.Config.Minify.Enabled,
+		MinifySkip: append(r.MinifySkip, config.Config.Minify.Skip...),
+		HashAssets: r.HashAssets || config.Config.HashAssets,
+		SourceMaps: r.SourceMaps || config.Config.SourceMaps,
+		Jobs:       r.Jobs,
+		Sitemap:    r.Sitemap || config.Config.Sitemap,
+		StrictI18n: r.StrictI18n || config.Config.StrictI18n,
+		KeepGoing:  r.KeepGoing,
+	})
+
+	errorCount, warningCount := 0, 0
+	for _, d := range buildtool.Diagnostics() {
+		if d.Warning {
+			fmt.Println("warning:", d)
+			warningCount++
+		} else {
+			fmt.Println("error:", d)
+			errorCount++
+		}
+	}
+
 	if err != nil {
+		// Failures outside of the files, such as the output can't be written
+		if errorCount == 0 {
+			fmt.Println("error:", err)
+			errorCount++
+		}
+		var commitErr *builder.CommitError
+		if errors.As(err, &commitErr) && !commitErr.Restored {
+			fmt.Printf("Build failed, %d error(s), %d warning(s), %s couldn't be restored and may be incomplete\n", errorCount, warningCount, r.BuildDir)
+		} else {
+			fmt.Printf("Build failed, %d error(s), %d warning(s), %s was left unchanged\n", errorCount, warningCount, r.BuildDir)
+		}
 		os.Exit(1)
 	}
 
@@ -121,6 +202,90 @@ func (r *CommandServe) Run(ctx *kong.Context) error {
 	}
 
 	serv := server.NewServer(r.SrcDir, r.BuildDir, ".", strconv.Itoa(r.Port), config.Config.ServeConfig.Redirect404)
+	serv.SetBuilderOpts(&builder.BuilderOpts{
+		SourceMaps: r.SourceMaps || config.Config.SourceMaps,
+		Sitemap:    config.Config.Sitemap,
+	})
+	if r.Poll || config.Config.ServeConfig.Poll {
+		serv.SetPollInterval(watcher.DefaultPollInterval)
+	}
+	serv.SetInMemory(r.InMemory || config.Config.ServeConfig.InMemory)
 
 	return serv.Start(!r.Build)
 }
+
+func (r *CommandInit) Run(ctx *kong.Context) error {
+	applyVerbose(r.Verbose)
+
+	err := scaffold.Create(scaffold.Options{
+		Dir:          r.Dir,
+		Languages:    r.Languages,
+		RootLanguage: r.RootLanguage,
+		HTMLDir:      r.HTMLDir,
+	})
+	if err != nil {
+		tlogger.Error("msg", "Failed to create project", "err", err)
+		os.Exit(1)
+	}
+
+	return nil
+}
+
+func (r *CommandConfigCheck) Run(ctx *kong.Context) error {
+	issues, err := config.Check(CLI.ConfigFile, r.SrcDir)
+	if err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+
+	errorCount := 0
+	for _, issue := range issues {
+		if issue.Warning {
+			fmt.Println("warning:", issue)
+		} else {
+			fmt.Println("error:", issue)
+			errorCount++
+		}
+	}
+
+	if errorCount > 0 {
+		fmt.Printf("%d error(s), %d warning(s)\n", errorCount, len(issues)-errorCount)
+		os.Exit(1)
+	}
+	fmt.Printf("Configuration OK, %d warning(s)\n", len(issues))
+
+	return nil
+}
+
+func (r *CommandI18nCheck) Run(ctx *kong.Context) error {
+	applyVerbose(r.Verbose)
+
+	if r.SrcDir == "" {
+		r.SrcDir = "src"
+	}
+
+	buildtool := builder.NewBuilder(r.SrcDir, "", ".")
+	issues, err := buildtool.CheckTranslations()
+	if err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+
+	errorCount := 0
+	for _, issue := range issues {
+		if issue.Warning {
+			fmt.Println("warning:", issue)
+		} else {
+			fmt.Println("error:", issue)
+			errorCount++
+		}
+	}
+
+	if errorCount > 0 || (r.Strict && len(issues) > 0) {
+		fmt.Printf("%d error(s), %d warning(s)\n", errorCount, len(issues)-errorCount)
+		os.Exit(1)
+	}
+	fmt.Printf("Translations OK, %d warning(s)\n", len(issues))
+
+	return nil
+}
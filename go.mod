@@ -5,10 +5,12 @@ go 1.19
 require (
 	github.com/davecgh/go-spew v1.1.1
 	github.com/go-kit/log v0.2.1
+	github.com/yuin/goldmark v1.5.4
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
-	github.com/tdewolff/parse/v2 v2.6.2 // indirect
+	github.com/tdewolff/parse/v2 v2.6.2
 	golang.org/x/sys v0.0.0-20220804214406-8e32c043e418 // indirect
 )
 
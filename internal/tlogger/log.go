@@ -17,7 +17,7 @@ var hlog log.Logger
 var ApplyLogLevel func(string)
 
 func init() {
-	Log = log.NewLogfmtLogger(os.Stdout)
+	Log = log.NewLogfmtLogger(log.NewSyncWriter(os.Stdout))
 	hlog = log.With(Log, "ts", log.DefaultTimestampUTC, "caller", log.Caller(6))
 	Log = log.With(Log, "ts", log.DefaultTimestampUTC, "caller", log.Caller(5))
 
@@ -1,18 +1,40 @@
 package watcher
 
 import (
-	"log"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/toastate/toastfront/internal/tlogger"
 )
 
+// DefaultPollInterval is used by the polling watcher when no interval is given
+const DefaultPollInterval = time.Second
+
+// StartWatcher sends the paths created, written, removed or renamed under folder.
+// Directories created after the start are watched too.
+// It falls back to polling when inotify (or the platform equivalent) can't be used.
 func StartWatcher(folder string) <-chan string {
 	wch, err := fsnotify.NewWatcher()
 	if err != nil {
-		panic(err)
+		tlogger.Warn("msg", "Can't start file watcher, falling back to polling", "err", err)
+		return StartPollingWatcher(folder, DefaultPollInterval)
+	}
+
+	err = filepath.Walk(folder, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return wch.Add(path)
+		}
+		return nil
+	})
+	if err != nil {
+		wch.Close()
+		tlogger.Warn("msg", "Can't watch source directory, falling back to polling", "err", err)
+		return StartPollingWatcher(folder, DefaultPollInterval)
 	}
 
 	outCh := make(chan string, 100)
@@ -24,26 +46,226 @@ func StartWatcher(folder string) <-chan string {
 				if !ok {
 					return
 				}
-				log.Println("event:", event)
-				if event.Op&fsnotify.Write == fsnotify.Write {
+				tlogger.Debug("msg", "File event", "event", event)
+
+				switch {
+				case event.Op&fsnotify.Create == fsnotify.Create:
+					tlogger.Info("msg", "Detected creation", "path", event.Name)
+					outCh <- event.Name
+
+					fi, err := os.Stat(event.Name)
+					if err == nil && fi.IsDir() {
+						// Files may have been created in the directory before it was watched
+						addDirectory(wch, event.Name, outCh)
+					}
+				case event.Op&fsnotify.Write == fsnotify.Write:
 					tlogger.Info("msg", "Detected change", "path", event.Name)
 					outCh <- event.Name
+				case event.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+					// Removed directories are unwatched by fsnotify itself
+					tlogger.Info("msg", "Detected removal", "path", event.Name)
+					outCh <- event.Name
 				}
 			case err, ok := <-wch.Errors:
 				if !ok {
 					return
 				}
-				log.Println("error:", err)
+				tlogger.Error("msg", "File watcher error", "err", err)
 			}
 		}
 	}()
 
-	filepath.Walk(folder, func(path string, fi os.FileInfo, err error) error {
-		if fi.IsDir() {
+	return outCh
+}
+
+// addDirectory watches dir and its sub directories and sends everything found in them
+func addDirectory(wch *fsnotify.Watcher, dir string, outCh chan<- string) {
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if path == dir {
 			return wch.Add(path)
 		}
+
+		outCh <- path
+		if fi.IsDir() {
+			err = wch.Add(path)
+			if err != nil {
+				tlogger.Error("msg", "Can't watch new directory", "path", path, "err", err)
+			}
+		}
 		return nil
 	})
+}
 
+type pollEntry struct {
+	modTime time.Time
+	size    int64
+	isDir   bool
+}
+
+// StartPollingWatcher sends the same changes as StartWatcher by scanning folder every interval.
+// It works on every filesystem (network shares, containers volumes...) at the cost of some latency.
+func StartPollingWatcher(folder string, interval time.Duration) <-chan string {
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+
+	outCh := make(chan string, 100)
+	known := scanFolder(folder)
+
+	tlogger.Info("msg", "Polling source directory for changes", "path", folder, "interval", interval)
+
+	go func() {
+		for range time.Tick(interval) {
+			current := scanFolder(folder)
+
+			for path, entry := range current {
+				prev, ok := known[path]
+				switch {
+				case !ok:
+					tlogger.Info("msg", "Detected creation", "path", path)
+					outCh <- path
+				case !entry.isDir && (prev.modTime != entry.modTime || prev.size != entry.size):
+					tlogger.Info("msg", "Detected change", "path", path)
+					outCh <- path
+				}
+			}
+			for path := range known {
+				if _, ok := current[path]; !ok {
+					tlogger.Info("msg", "Detected removal", "path", path)
+					outCh <- path
+				}
+			}
+
+			known = current
+		}
+	}()
+
+	return outCh
+}
+
+func scanFolder(folder string) map[string]pollEntry {
+	entries := map[string]pollEntry{}
+	filepath.Walk(folder, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || path == folder {
+			return nil
+		}
+		entries[path] = pollEntry{modTime: fi.ModTime(), size: fi.Size(), isDir: fi.IsDir()}
+		return nil
+	})
+	return entries
+}
+
+// StartFilesWatcher sends the paths of files when they are created, written, removed or renamed.
+// Their directories are watched rather than the files, as editors often replace a file to save it.
+func StartFilesWatcher(files []string) <-chan string {
+	wanted := map[string]struct{}{}
+	for _, f := range files {
+		wanted[filepath.Clean(f)] = struct{}{}
+	}
+
+	wch, err := fsnotify.NewWatcher()
+	if err != nil {
+		tlogger.Warn("msg", "Can't start file watcher, falling back to polling", "err", err)
+		return StartFilesPollingWatcher(files, DefaultPollInterval)
+	}
+
+	for f := range wanted {
+		dir := filepath.Dir(f)
+		if _, err := os.Stat(dir); err != nil {
+			continue
+		}
+		err = wch.Add(dir)
+		if err != nil {
+			wch.Close()
+			tlogger.Warn("msg", "Can't watch files, falling back to polling", "path", dir, "err", err)
+			return StartFilesPollingWatcher(files, DefaultPollInterval)
+		}
+	}
+
+	outCh := make(chan string, 100)
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-wch.Events:
+				if !ok {
+					return
+				}
+				if _, ok := wanted[filepath.Clean(event.Name)]; !ok {
+					continue
+				}
+				if event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Remove|fsnotify.Rename) != 0 {
+					tlogger.Info("msg", "Detected change", "path", event.Name)
+					outCh <- event.Name
+				}
+			case err, ok := <-wch.Errors:
+				if !ok {
+					return
+				}
+				tlogger.Error("msg", "File watcher error", "err", err)
+			}
+		}
+	}()
+
+	return outCh
+}
+
+// StartFilesPollingWatcher sends the same changes as StartFilesWatcher by checking files every interval
+func StartFilesPollingWatcher(files []string, interval time.Duration) <-chan string {
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+
+	outCh := make(chan string, 100)
+	known := statFiles(files)
+
+	go func() {
+		for range time.Tick(interval) {
+			current := statFiles(files)
+
+			for path, entry := range current {
+				if prev, ok := known[path]; !ok || prev.modTime != entry.modTime || prev.size != entry.size {
+					tlogger.Info("msg", "Detected change", "path", path)
+					outCh <- path
+				}
+			}
+			for path := range known {
+				if _, ok := current[path]; !ok {
+					tlogger.Info("msg", "Detected removal", "path", path)
+					outCh <- path
+				}
+			}
+
+			known = current
+		}
+	}()
+
+	return outCh
+}
+
+func statFiles(files []string) map[string]pollEntry {
+	entries := map[string]pollEntry{}
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err == nil {
+			entries[f] = pollEntry{modTime: fi.ModTime(), size: fi.Size(), isDir: fi.IsDir()}
+		}
+	}
+	return entries
+}
+
+// Merge sends the paths of every channel on a single one
+func Merge(chs ...<-chan string) <-chan string {
+	outCh := make(chan string, 100)
+	for _, ch := range chs {
+		go func(ch <-chan string) {
+			for p := range ch {
+				outCh <- p
+			}
+		}(ch)
+	}
 	return outCh
 }
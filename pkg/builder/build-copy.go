@@ -3,7 +3,6 @@ package builder
 import (
 	"io/fs"
 	"os"
-	"path/filepath"
 	"strings"
 
 	"github.com/toastate/toastfront/internal/tlogger"
@@ -39,7 +38,11 @@ func (cp *CopyBuilder) RewritePath(path string) string {
 }
 
 func (cp *CopyBuilder) Process(path string, file fs.FileInfo) error {
-	os.MkdirAll(filepath.Join(cp.builder.buildDir, filepath.Dir(path)), 0755)
-	_, err := copyFile(filepath.Join(cp.builder.srcDir, path), filepath.Join(cp.builder.buildDir, path))
-	return err
+	_, err := cp.builder.copyFile(path, path)
+	if err != nil {
+		return err
+	}
+
+	cp.builder.registerOutput(path, outputCopy)
+	return nil
 }
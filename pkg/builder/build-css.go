@@ -1,14 +1,14 @@
 package builder
 
 import (
+	"bytes"
 	"encoding/json"
-	htemplate "html/template"
+	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
-	ttemplate "text/template"
 
 	"github.com/toastate/toastfront/internal/tlogger"
 	"github.com/toastate/toastfront/pkg/config"
@@ -63,88 +63,105 @@ func (cb *CSSBuilder) IsCssFile(path string, file fs.FileInfo) bool {
 func (cb *CSSBuilder) Process(path string, file fs.FileInfo) error {
 	tlogger.Debug("builder", "css", "msg", "processing", "file", path)
 
-	if cb.depth == 0 {
-		cb.data = map[string]interface{}{}
+	// Files are processed concurrently, each one works on its own copy of the builder
+	run := &CSSBuilder{
+		folder:    cb.folder,
+		extension: cb.extension,
+		varsFile:  cb.varsFile,
+		builder:   cb.builder,
+		data:      map[string]interface{}{},
 	}
 
-	varsPath := filepath.Join(cb.builder.srcDir, cb.folder, cb.varsFile)
-	vf, err := os.Open(varsPath)
+	varsPath := filepath.Join(cb.folder, cb.varsFile)
+	vf, err := cb.builder.openSource(varsPath)
 	if err != nil {
-		tlogger.Warn("builder", "css", "msg", "Can't open css vars file", "file", varsPath, "err", err)
+		if !os.IsNotExist(err) {
+			tlogger.Warn("builder", "css", "msg", "Can't open css vars file", "file", varsPath, "err", err)
+			cb.builder.diagnostics.warn("css", varsPath, 0, "can't open css vars file")
+		}
 	} else {
 		defer vf.Close()
-		err = json.NewDecoder(vf).Decode(&cb.data)
+		err = json.NewDecoder(vf).Decode(&run.data)
 		if err != nil {
 			tlogger.Error("builder", "css", "msg", "Can't decode css vars file", "file", varsPath, "err", err)
 			return err
 		}
 	}
 
-	f, err := cb.ProcessAsByte(path, file)
+	f, lines, err := run.processLines(path, file)
 	if err != nil {
-		return err
+		return newBuildError("css", path, 0, err)
 	}
 
-	of, err := os.OpenFile(filepath.Join(cb.builder.buildDir, path), os.O_CREATE|os.O_RDWR, 0644)
+	of, err := cb.builder.createOutput(path)
 	if err != nil {
 		tlogger.Error("builder", "css", "msg", "output file creation", "file", path, "err", err)
 		return err
 	}
-	defer of.Close()
-
-	// wr := filewriter.Writer("text/css", of)
-
-	env := os.Environ()
-	for i := 0; i < len(env); i++ {
-		spl := strings.Split(env[i], "=")
-		if len(spl) == 2 {
-			cb.data[spl[0]] = spl[1]
-		}
+	var wr io.WriteCloser
+	var buf *bytes.Buffer
+	if cb.builder.opts.SourceMaps {
+		// The source map is written once the whole template output is known
+		defer of.Close()
+		buf = &bytes.Buffer{}
+		wr = nopWriteCloser{buf}
+	} else {
+		wr = cb.builder.outputWriter(MediaTypeCSS, of)
 	}
+	defer wr.Close()
 
-	if config.Config.UnsafeVars {
-		t, err := ttemplate.New(path).Delims(`"{{`, `}}"`).Parse(string(f))
-		if err != nil {
-			tlogger.Error("builder", "css", "msg", "temple", "file", path, "err", err)
-			return err
-		}
+	cb.builder.addEnv(run.data)
+	cb.builder.addBuildEnv("css", path, run.data, "")
 
-		err = t.Execute(of, cb.data)
-		if err != nil {
-			tlogger.Error("builder", "css", "msg", "templater", "file", path, "err", err)
-			return err
-		}
-	} else {
-		t, err := htemplate.New(path).Delims(`"{{`, `}}"`).Parse(string(f))
-		if err != nil {
-			tlogger.Error("builder", "css", "msg", "temple", "file", path, "err", err)
-			return err
-		}
+	parts := []templatePart{{name: path, content: f, lines: lines}}
+	cb.builder.warnHiddenEnvRefs("css", parts, cssActionRegexp, run.data)
+	execParts := parts
+	if buf != nil {
+		// The output lines are mapped to the source ones once the template ran
+		execParts = []templatePart{{name: path, content: markLines(f, `"{{`, `}}"`), lines: lines}}
+	}
+	err = executeTemplate(wr, `"{{`, `}}"`, execParts, run.builder.templateFuncs(run.data), run.data)
+	if err != nil {
+		tlogger.Error("builder", "css", "msg", "templater", "file", path, "err", err)
+		return templateError("css", path, err, parts)
+	}
 
-		err = t.Execute(of, cb.data)
-		if err != nil {
-			tlogger.Error("builder", "css", "msg", "templater", "file", path, "err", err)
-			return err
-		}
+	err = wr.Close()
+	if err == nil && buf != nil {
+		content, outLines := unmarkLines(buf.Bytes(), lines)
+		err = cb.builder.writeWithSourceMap(MediaTypeCSS, path, of, content, outLines)
+	}
+	if err != nil {
+		tlogger.Error("builder", "css", "msg", "output file write", "file", path, "err", err)
+		return err
 	}
 
+	cb.builder.registerOutput(path, outputCSS)
+
 	return nil
 }
 
 func (cb *CSSBuilder) ProcessAsByte(path string, file fs.FileInfo) ([]byte, error) {
+	f, _, err := cb.processLines(path, file)
+	return f, err
+}
+
+// processLines is ProcessAsByte keeping track of the source of every output line
+func (cb *CSSBuilder) processLines(path string, file fs.FileInfo) ([]byte, []sourceLine, error) {
 	if cb.depth > 5 {
 		tlogger.Debug("builder", "css", "msg", "file error", "file", path, "err", "reached max recursion depth of 5, import loop ?")
-		return nil, ErrTooDeep
+		return nil, nil, ErrTooDeep
 	}
-	f, err := os.ReadFile(filepath.Join(cb.builder.srcDir, path))
+	f, err := cb.builder.readSource(path)
 	if err != nil {
 		tlogger.Error("builder", "css", "msg", "file error", "file", path, "err", err)
-		return nil, err
+		return nil, nil, err
 	}
 
 	f = replaceWindowsCarriageReturn(f)
 
-	f = CSSBuilderImportRegexp.ReplaceAllFunc(f, func(match []byte) []byte {
+	var importErr error
+	f, lines := spliceImports(CSSBuilderImportRegexp, path, f, func(match []byte, line int) ([]byte, []sourceLine) {
 		p := string(CSSBuilderImportRegexp.FindSubmatch(match)[1])
 
 		p = strings.ReplaceAll(p, "/", string(os.PathSeparator))
@@ -155,15 +172,20 @@ func (cb *CSSBuilder) ProcessAsByte(path string, file fs.FileInfo) ([]byte, erro
 
 		p = filepath.Join(cb.folder, p)
 
-		fileData, err := os.Stat(filepath.Join(cb.builder.srcDir, p))
+		// Registered first so the importer gets rebuilt when a missing file is created
+		cb.builder.addDep(p, path)
+
+		fileData, err := cb.builder.statSource(p)
 		if err != nil {
 			tlogger.Error("builder", "css", "msg", "file error import", "sourcefile", path, "expectedfile", p, "err", err)
-			return []byte{'\n'}
+			cb.builder.keepImportError(&importErr, "css", path, line, p, err)
+			return []byte{'\n'}, nil
 		}
 
 		if !cb.IsCssFile(p, fileData) {
-			tlogger.Error("builder", "css", "msg", "file error import", "sourcefile", path, "expectedfile", p, "err", "import types mismatched")
-			return []byte{'\n'}
+			tlogger.Error("builder", "css", "msg", "file error import", "sourcefile", path, "expectedfile", p, "err", ErrImportTypeMismatch)
+			cb.builder.keepImportError(&importErr, "css", path, line, p, ErrImportTypeMismatch)
+			return []byte{'\n'}, nil
 		}
 
 		nestedCB := &CSSBuilder{
@@ -175,23 +197,21 @@ func (cb *CSSBuilder) ProcessAsByte(path string, file fs.FileInfo) ([]byte, erro
 			data:      cb.data,
 		}
 
-		if _, ok := cb.builder.fileDeps[p]; ok {
-			cb.builder.fileDeps[p][path] = struct{}{}
-		} else {
-			cb.builder.fileDeps[p] = map[string]struct{}{path: {}}
-		}
-
-		c, err := nestedCB.ProcessAsByte(p, fileData)
+		c, cLines, err := nestedCB.processLines(p, fileData)
 		if err != nil {
 			tlogger.Error("builder", "css", "msg", "file error process", "sourcefile", path, "expectedfile", p, "err", err)
-			return []byte{'\n'}
+			cb.builder.keepImportError(&importErr, "css", path, line, p, err)
+			return []byte{'\n'}, nil
 		}
 		if len(c) == 0 || c[len(c)-1] != '\n' {
 			c = append(c, '\n')
 		}
 
-		return c
+		return c, cLines
 	})
+	if importErr != nil {
+		return nil, nil, importErr
+	}
 
-	return f, nil
+	return f, lines, nil
 }
@@ -3,7 +3,6 @@ package builder
 import (
 	"io/fs"
 	"os"
-	"path/filepath"
 	"strings"
 
 	"github.com/toastate/toastfront/internal/tlogger"
@@ -62,9 +61,9 @@ func (fb *FolderBuilder) Process(path string, file fs.FileInfo) error {
 		return nil
 	}
 
-	newFolder := filepath.Join(fb.builder.buildDir, path)
+	newFolder := fb.builder.outputName(path)
 
-	err := os.MkdirAll(newFolder, 0755)
+	err := fb.builder.output.MkdirAll(newFolder)
 	if err != nil {
 		tlogger.Error("builder", "folder", "file", path, "msg", "Failed to create folder", "err", err)
 		return err
@@ -1,26 +1,32 @@
 package builder
 
 import (
+	"bytes"
 	"encoding/json"
-	htemplate "html/template"
+	"errors"
+	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
-	ttemplate "text/template"
 
 	"github.com/toastate/toastfront/internal/helpers"
 	"github.com/toastate/toastfront/internal/tlogger"
 	"github.com/toastate/toastfront/pkg/config"
 )
 
-var HTMLBuilderImportRegexp = regexp.MustCompile(`(?m)<!--\s*#import\s+(.*)\s*-->`)
+var HTMLBuilderImportRegexp = regexp.MustCompile(`<!--\s*#import\s+(\S+?)(?:\s+(.*?))?\s*-->`)
+var HTMLImportArgRegexp = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)=(?:"([^"]*)"|'([^']*)'|(\S+))\s*`)
+var HTMLBuilderLayoutRegexp = regexp.MustCompile(`<!--[ \t]*#layout[ \t]+(\S+?)[ \t]*-->`)
 
 type HTMLBuilder struct {
 	builder  *Builder
-	depth    int // To avoid infinite recursive imports
-	baseData map[string]interface{}
+	depth    int                               // To avoid infinite recursive imports
+	baseData map[string]map[string]interface{} // Global vars of the current language and of its fallbacks
+
+	importArgs *[]map[string]interface{} // Arguments of the page imports, shared with the nested imports
 
 	extension  string
 	folder     string
@@ -79,190 +85,243 @@ func (cb *HTMLBuilder) RewritePath(path string) string {
 func (cb *HTMLBuilder) GetPathData(path string) map[string]interface{} {
 	varsDir := path[:len(path)-len(cb.extension)]
 	out := cb.GetPathDataDir(varsDir)
+	cb.builder.addEnv(out)
+	cb.builder.addBuildEnv("html", path, out, path)
+
+	return out
+}
+
+func (cb *HTMLBuilder) GetPathDataDir(varsDir string) map[string]interface{} {
+	baseData := cb.baseData
+	if baseData == nil { // Called outside of Process, from the js builder
+		baseData, _ = cb.loadBaseData()
+	}
+
+	lang := cb.builder.currentLanguage
+	varsPath := filepath.Join(cb.varsFolder, varsDir)
+	out, err := cb.folderVars(varsPath, lang, baseData[lang])
+	if err != nil {
+		out = map[string]interface{}{}
+	}
 
-	env := os.Environ()
-	for i := 0; i < len(env); i++ {
-		spl := strings.Split(env[i], "=")
-		if len(spl) == 2 {
-			out[spl[0]] = spl[1]
+	// Only the keys no vars file of the language defines are taken from the fallback languages
+	for _, lg := range config.Config.ResolvedFallbacks(lang) {
+		fallback, err := cb.folderVars(varsPath, lg, baseData[lg])
+		if err != nil {
+			continue
+		}
+		for _, k := range mergeMissingVars(out, fallback, "") {
+			tlogger.Debug("builder", "html", "msg", "Missing var, falling back", "key", k, "lang", lang, "fallback", lg, "folder", varsPath)
 		}
 	}
 
 	return out
 }
 
-func (cb *HTMLBuilder) GetPathDataDir(varsDir string) map[string]interface{} {
-	out := make(map[string]interface{})
-	{
-		bt, _ := helpers.MarshalJson(cb.baseData)
-		json.Unmarshal(bt, &out)
+func (cb *HTMLBuilder) Process(path string, file fs.FileInfo) error {
+	tlogger.Debug("builder", "html", "msg", "processing", "file", path)
+
+	run, err := cb.newRun()
+	if err != nil {
+		return err
+	}
+	return run.process(path, file)
+}
+
+// newRun returns the copy of the builder processing a page.
+// Files are processed concurrently, each one works on its own copy of the builder.
+func (cb *HTMLBuilder) newRun() (*HTMLBuilder, error) {
+	baseData, err := cb.loadBaseData()
+	if err != nil {
+		return nil, err
 	}
 
-	varsPath := ""
-	varsPath = filepath.Join(cb.builder.srcDir, cb.varsFolder, varsDir)
+	return &HTMLBuilder{
+		folder:     cb.folder,
+		extension:  cb.extension,
+		varsFolder: cb.varsFolder,
+		builder:    cb.builder,
+		baseData:   baseData,
+		importArgs: &[]map[string]interface{}{},
+	}, nil
+}
 
-	{
-		varsFile := filepath.Join(varsPath, "common.json")
+// loadBaseData reads the global vars of the current language and of its fallback languages, by language
+func (cb *HTMLBuilder) loadBaseData() (map[string]map[string]interface{}, error) {
+	lang := cb.builder.currentLanguage
+	baseData := map[string]map[string]interface{}{}
 
-		f, err := os.Open(varsFile)
-		if err == nil {
-			secondaryOut := make(map[string]interface{})
-			err := json.NewDecoder(f).Decode(&secondaryOut)
-			if err != nil {
-				tlogger.Error("builder", "html", "msg", "Can't decode html vars file", "file", varsFile, "err", err)
-			}
-			for k, v := range secondaryOut {
-				out[k] = v
-			}
-			f.Close()
+	for _, lg := range append([]string{lang}, config.Config.ResolvedFallbacks(lang)...) {
+		vars, err := cb.folderVars(cb.varsFolder, lg, nil)
+		if err != nil {
+			return nil, err
 		}
+		baseData[lg] = vars
+	}
+
+	return baseData, nil
+}
+
+// folderVars lays the common.json then the lang-<code>.json files of varsPath over a copy of base
+func (cb *HTMLBuilder) folderVars(varsPath, lang string, base map[string]interface{}) (map[string]interface{}, error) {
+	out := map[string]interface{}{}
+	if base != nil {
+		bt, _ := helpers.MarshalJson(base)
+		json.Unmarshal(bt, &out)
 	}
 
-	{
-
-		varsFile := filepath.Join(varsPath, "lang-"+cb.builder.currentLanguage+".json")
-		f, err := os.Open(varsFile)
-		if err == nil {
-			secondaryOut := make(map[string]interface{})
-			err := json.NewDecoder(f).Decode(&secondaryOut)
-			if err != nil {
-				tlogger.Error("builder", "html", "msg", "Can't decode html vars file", "file", varsFile, "err", err)
-			}
-			for k, v := range secondaryOut {
-				out[k] = v
-			}
-			f.Close()
+	for _, name := range []string{"common.json", "lang-" + lang + ".json"} {
+		vars, err := cb.builder.readVarsFile(filepath.Join(varsPath, name))
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range vars {
+			out[k] = v
 		}
 	}
 
-	return out
+	return out, nil
 }
 
-func (cb *HTMLBuilder) Process(path string, file fs.FileInfo) error {
-	tlogger.Debug("builder", "html", "msg", "processing", "file", path)
+// readVarsFile decodes a vars file, a missing file holds no vars
+func (b *Builder) readVarsFile(varsFile string) (map[string]interface{}, error) {
+	out := map[string]interface{}{}
+
+	f, err := b.openSource(varsFile)
+	if err != nil {
+		return out, nil
+	}
+	defer f.Close()
+
+	err = json.NewDecoder(f).Decode(&out)
+	if err != nil {
+		tlogger.Error("builder", "html", "msg", "Can't decode html vars file", "file", varsFile, "err", err)
+		return nil, err
+	}
+	return out, nil
+}
 
-	if cb.depth == 0 {
-		cb.baseData = map[string]interface{}{}
-
-		varsPath := filepath.Join(cb.builder.srcDir, cb.varsFolder)
-
-		{
-			varsFile := filepath.Join(varsPath, "common.json")
-			f, err := os.Open(varsFile)
-			if err == nil {
-				err = json.NewDecoder(f).Decode(&cb.baseData)
-				f.Close()
-				if err != nil {
-					tlogger.Error("builder", "html", "msg", "Can't decode html vars file", "file", varsFile, "err", err)
-					return err
-				}
-			}
+// mergeMissingVars copies to dst the keys of src it lacks, including the ones of nested objects, and returns their dotted paths
+func mergeMissingVars(dst, src map[string]interface{}, prefix string) []string {
+	keys := make([]string, 0, len(src))
+	for k := range src {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	added := []string{}
+	for _, k := range keys {
+		cur, ok := dst[k]
+		if !ok {
+			dst[k] = src[k]
+			added = append(added, prefix+k)
+			continue
 		}
-		{
-			varsFile := filepath.Join(varsPath, "lang-"+cb.builder.currentLanguage+".json")
-			f, err := os.Open(varsFile)
-			if err == nil {
-				tmp := make(map[string]interface{})
-				err = json.NewDecoder(f).Decode(&tmp)
-				f.Close()
-				if err != nil {
-					tlogger.Error("builder", "html", "msg", "Can't decode html vars file", "file", varsFile, "err", err)
-					return err
-				}
-				for k, v := range tmp {
-					cb.baseData[k] = v
-				}
-			}
+
+		curMap, ok := cur.(map[string]interface{})
+		srcMap, ok2 := src[k].(map[string]interface{})
+		if ok && ok2 {
+			added = append(added, mergeMissingVars(curMap, srcMap, prefix+k+".")...)
 		}
 	}
+	return added
+}
+
+// pageParts returns the templates rendering the page at path: its layouts followed by the page with its imports
+func (cb *HTMLBuilder) pageParts(path string, file fs.FileInfo) ([]templatePart, error) {
+	f, lines, err := cb.processLines(path, file)
+	if err != nil {
+		return nil, newBuildError("html", path, 0, err)
+	}
+
+	parts, err := cb.layoutParts(path, f, lines)
+	if err != nil {
+		return nil, newBuildError("html", path, 0, err)
+	}
+	return parts, nil
+}
 
-	f, err := cb.ProcessAsByte(path, file)
+func (cb *HTMLBuilder) process(path string, file fs.FileInfo) error {
+	parts, err := cb.pageParts(path, file)
 	if err != nil {
 		return err
 	}
 
 	pathOut := cb.RewritePath(path)
 
-	of, err := os.OpenFile(filepath.Join(cb.builder.buildDir, pathOut), os.O_CREATE|os.O_RDWR, 0644)
+	of, err := cb.builder.createOutput(pathOut)
 	if err != nil {
 		tlogger.Error("builder", "html", "msg", "output file creation", "file", pathOut, "err", err)
 		return err
 	}
-	defer of.Close()
+	wr := cb.builder.outputWriter(MediaTypeHTML, of)
+	defer wr.Close()
 
-	// wr := filewriter.Writer("text/html", of)
 	pathData := cb.GetPathData(pathOut)
+	cb.builder.warnHiddenEnvRefs("html", parts, htmlActionRegexp, pathData)
 
-	wr := of
-
-	if config.Config.UnsafeVars {
-		t, err := ttemplate.New(path).Delims(`<!--#`, `-->`).Parse(string(f))
-
-		if err != nil {
-			tlogger.Error("builder", "html", "msg", "templater", "file", path, "err", err)
-			return err
-		}
-
-		err = t.Execute(wr, pathData)
-		if err != nil {
-			tlogger.Error("builder", "html", "msg", "templater", "file", path, "err", err)
-			return err
-		}
-	} else {
-		t, err := htemplate.New(path).Delims(`<!--#`, `-->`).Parse(string(f))
-
-		if err != nil {
-			tlogger.Error("builder", "html", "msg", "templater", "file", path, "err", err)
-			return err
-		}
-
-		err = t.Execute(wr, pathData)
-		if err != nil {
-			tlogger.Error("builder", "html", "msg", "templater", "file", path, "err", err)
-			return err
-		}
+	err = executeTemplate(wr, `<!--#`, `-->`, parts, cb.builder.pageFuncs(cb, pathOut, pathData), pathData)
+	if err != nil {
+		tlogger.Error("builder", "html", "msg", "templater", "file", path, "err", err)
+		return templateError("html", path, err, parts)
+	}
 
+	err = wr.Close()
+	if err != nil {
+		tlogger.Error("builder", "html", "msg", "output file write", "file", pathOut, "err", err)
+		return err
 	}
 
+	cb.builder.registerOutput(pathOut, outputHTML)
+
 	return nil
 }
 
 func (cb *HTMLBuilder) ProcessAsByte(path string, file fs.FileInfo) ([]byte, error) {
+	f, _, err := cb.processLines(path, file)
+	return f, err
+}
 
+// processLines is ProcessAsByte keeping track of the source of every output line
+func (cb *HTMLBuilder) processLines(path string, file fs.FileInfo) ([]byte, []sourceLine, error) {
 	if cb.depth > 5 {
 		tlogger.Debug("builder", "html", "msg", "file error", "file", path, "err", "reached max recursion depth of 5, import loop ?")
-		return nil, ErrTooDeep
+		return nil, nil, ErrTooDeep
 	}
-	f, err := os.ReadFile(filepath.Join(cb.builder.srcDir, path))
+	f, err := cb.builder.readSource(path)
 	if err != nil {
 		tlogger.Error("builder", "html", "msg", "file error", "file", path, "err", err)
-		return nil, err
+		return nil, nil, err
 	}
 
 	f = replaceWindowsCarriageReturn(f)
 
-	f = HTMLBuilderImportRegexp.ReplaceAllFunc(f, func(match []byte) []byte {
-		p := string(HTMLBuilderImportRegexp.FindSubmatch(match)[1])
+	var importErr error
+	f, lines := spliceImports(HTMLBuilderImportRegexp, path, f, func(match []byte, line int) ([]byte, []sourceLine) {
+		sub := HTMLBuilderImportRegexp.FindSubmatch(match)
+		p := cb.importPath(string(sub[1]))
 
-		p = strings.ReplaceAll(p, "/", string(os.PathSeparator))
-
-		if p[0] == os.PathSeparator {
-			p = p[1:]
+		args, err := parseImportArgs(string(sub[2]))
+		if err != nil {
+			tlogger.Error("builder", "html", "msg", "import arguments", "sourcefile", path, "expectedfile", p, "err", err)
+			cb.builder.keepImportError(&importErr, "html", path, line, p, err)
+			return []byte{'\n'}, nil
 		}
 
-		if cb.folder != "" {
-			p = filepath.Join(cb.folder, p)
-		}
+		// Registered first so the importer gets rebuilt when a missing file is created
+		cb.builder.addDep(p, path)
 
-		fileData, err := os.Stat(filepath.Join(cb.builder.srcDir, p))
+		fileData, err := cb.builder.statSource(p)
 		if err != nil {
 			tlogger.Error("builder", "html", "msg", "file error import", "sourcefile", path, "expectedfile", p, "err", err)
-			return []byte{'\n'}
+			cb.builder.keepImportError(&importErr, "html", path, line, p, err)
+			return []byte{'\n'}, nil
 		}
 
 		if !cb.IsHtmlFile(p, fileData) {
-			tlogger.Error("builder", "html", "msg", "file error import", "sourcefile", path, "expectedfile", p, "err", "import types mismatched")
-			return []byte{'\n'}
+			tlogger.Error("builder", "html", "msg", "file error import", "sourcefile", path, "expectedfile", p, "err", ErrImportTypeMismatch)
+			cb.builder.keepImportError(&importErr, "html", path, line, p, ErrImportTypeMismatch)
+			return []byte{'\n'}, nil
 		}
 
 		nestedCB := &HTMLBuilder{
@@ -272,25 +331,159 @@ func (cb *HTMLBuilder) ProcessAsByte(path string, file fs.FileInfo) ([]byte, err
 			builder:    cb.builder,
 			depth:      cb.depth + 1,
 			baseData:   cb.baseData,
+			importArgs: cb.importArgs,
 		}
 
-		if _, ok := cb.builder.fileDeps[p]; ok {
-			cb.builder.fileDeps[p][path] = struct{}{}
-		} else {
-			cb.builder.fileDeps[p] = map[string]struct{}{path: {}}
-		}
-
-		c, err := nestedCB.ProcessAsByte(p, fileData)
+		c, cLines, err := nestedCB.processLines(p, fileData)
 		if err != nil {
 			tlogger.Error("builder", "html", "msg", "file error process", "sourcefile", path, "expectedfile", p, "err", err)
-			return []byte{'\n'}
+			cb.builder.keepImportError(&importErr, "html", path, line, p, err)
+			return []byte{'\n'}, nil
 		}
-		if c[len(c)-1] != '\n' {
+		if len(c) == 0 || c[len(c)-1] != '\n' {
 			c = append(c, '\n')
 		}
 
-		return c
+		// The arguments are only visible inside the imported content, on top of the importer scope
+		if len(args) > 0 && cb.importArgs != nil {
+			*cb.importArgs = append(*cb.importArgs, args)
+			open := fmt.Sprintf("<!--#with toastfrontImport . %d -->", len(*cb.importArgs)-1)
+			c = append(append([]byte(open), c[:len(c)-1]...), []byte("<!--#end-->\n")...)
+		}
+
+		return c, cLines
 	})
+	if importErr != nil {
+		return nil, nil, importErr
+	}
+
+	return f, lines, nil
+}
+
+// parseImportArgs reads the arguments following an import path,
+// either key="value" pairs or a JSON object
+func parseImportArgs(s string) (map[string]interface{}, error) {
+	s = strings.TrimSpace(s)
+	args := map[string]interface{}{}
+
+	if strings.HasPrefix(s, "{") {
+		err := json.Unmarshal([]byte(s), &args)
+		if err != nil {
+			return nil, fmt.Errorf("invalid import arguments %s: %v", s, err)
+		}
+		return args, nil
+	}
+
+	for s != "" {
+		m := HTMLImportArgRegexp.FindStringSubmatch(s)
+		if m == nil {
+			return nil, fmt.Errorf("invalid import argument %s, expected key=\"value\"", strings.Fields(s)[0])
+		}
+		args[m[1]] = m[2] + m[3] + m[4]
+		s = s[len(m[0]):]
+	}
+	return args, nil
+}
+
+// importScope is the template data of a parameterised import: the importer data and the import arguments
+func (cb *HTMLBuilder) importScope(dot interface{}, i int) map[string]interface{} {
+	scope := map[string]interface{}{}
+	if data, ok := dot.(map[string]interface{}); ok {
+		for k, v := range data {
+			scope[k] = v
+		}
+	}
+	for k, v := range (*cb.importArgs)[i] {
+		scope[k] = v
+	}
+	return scope
+}
+
+// importPath resolves the path of an import or a layout, relative to the html directory, to a source path
+func (cb *HTMLBuilder) importPath(p string) string {
+	p = strings.ReplaceAll(p, "/", string(os.PathSeparator))
+
+	if p[0] == os.PathSeparator {
+		p = p[1:]
+	}
+
+	if cb.folder != "" {
+		p = filepath.Join(cb.folder, p)
+	}
+	return p
+}
+
+// layoutParts returns the layouts of the page at path, from the outermost one, followed by the page itself.
+// A page or a layout declares the layout it is rendered in with <!--#layout /path/to/layout.html-->,
+// it then only contributes the blocks it defines, overriding the ones of the layouts.
+func (cb *HTMLBuilder) layoutParts(path string, content []byte, lines []sourceLine) ([]templatePart, error) {
+	parts := []templatePart{}
+	name := path
+
+	for {
+		locs := HTMLBuilderLayoutRegexp.FindAllSubmatchIndex(content, -1)
+		if len(locs) == 0 {
+			return append([]templatePart{{name: name, content: content, lines: lines}}, parts...), nil
+		}
+
+		origin := lineOrigin(name, content, lines, locs[0][0])
+		if len(locs) > 1 {
+			second := lineOrigin(name, content, lines, locs[1][0])
+			return nil, &BuildError{Builder: "html", File: second.File, Line: second.Line, Message: "a file can only declare one layout"}
+		}
+
+		layout := cb.importPath(string(content[locs[0][2]:locs[0][3]]))
+
+		// The directive is removed without its line ending so lines keeps matching the content
+		stripped := append(append([]byte{}, content[:locs[0][0]]...), content[locs[0][1]:]...)
+		parts = append([]templatePart{{name: name, content: stripped, lines: lines}}, parts...)
+
+		if len(parts) > 5 {
+			tlogger.Debug("builder", "html", "msg", "file error", "file", path, "err", "reached max layout depth of 5, layout loop ?")
+			return nil, layoutError(origin, layout, ErrTooDeep)
+		}
+
+		// Registered first so the page gets rebuilt when a missing layout is created
+		cb.builder.addDep(layout, name)
+
+		info, err := cb.builder.statSource(layout)
+		if err != nil {
+			tlogger.Error("builder", "html", "msg", "file error layout", "sourcefile", name, "expectedfile", layout, "err", err)
+			return nil, layoutError(origin, layout, err)
+		}
+		if !cb.IsHtmlFile(layout, info) {
+			tlogger.Error("builder", "html", "msg", "file error layout", "sourcefile", name, "expectedfile", layout, "err", ErrImportTypeMismatch)
+			return nil, layoutError(origin, layout, ErrImportTypeMismatch)
+		}
+
+		content, lines, err = cb.processLines(layout, info)
+		if err != nil {
+			tlogger.Error("builder", "html", "msg", "file error layout", "sourcefile", name, "expectedfile", layout, "err", err)
+			return nil, layoutError(origin, layout, err)
+		}
+		name = layout
+	}
+}
+
+// lineOrigin returns the source of the line holding offset in content
+func lineOrigin(name string, content []byte, lines []sourceLine, offset int) sourceLine {
+	k := bytes.Count(content[:offset], []byte{'\n'})
+	if k < len(lines) && lines[k].File != "" {
+		return lines[k]
+	}
+	return sourceLine{File: name, Line: k + 1}
+}
 
-	return f, nil
+func layoutError(origin sourceLine, layout string, err error) error {
+	var be *BuildError
+	if errors.As(err, &be) {
+		return be
+	}
+	return &BuildError{
+		Builder: "html",
+		File:    origin.File,
+		Line:    origin.Line,
+		Message: fmt.Sprintf("layout %s: %v", layout, err),
+		Err:     err,
+	}
 }
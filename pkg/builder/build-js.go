@@ -65,41 +65,59 @@ func (cb *JSBuilder) IsJsFile(path string, file fs.FileInfo) bool {
 func (cb *JSBuilder) Process(path string, file fs.FileInfo) error {
 	tlogger.Debug("builder", "js", "msg", "processing", "file", path)
 
-	if cb.depth == 0 {
-		cb.data = map[string]interface{}{}
+	// Files are processed concurrently, each one works on its own copy of the builder
+	run := &JSBuilder{
+		folder:    cb.folder,
+		extension: cb.extension,
+		VarsFile:  cb.VarsFile,
+		builder:   cb.builder,
+		data:      map[string]interface{}{},
+	}
 
-		varsPath := filepath.Join(cb.builder.srcDir, cb.folder, cb.VarsFile)
-		vf, err := os.Open(varsPath)
+	varsPath := filepath.Join(cb.folder, cb.VarsFile)
+	vf, err := cb.builder.openSource(varsPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			tlogger.Warn("builder", "js", "msg", "Can't open js vars file", "file", varsPath, "err", err)
+			cb.builder.diagnostics.warn("js", varsPath, 0, "can't open js vars file")
+		}
+	} else {
+		defer vf.Close()
+		err = json.NewDecoder(vf).Decode(&run.data)
 		if err != nil {
-			if !os.IsNotExist(err) {
-				tlogger.Warn("builder", "js", "msg", "Can't open js vars file", "file", varsPath, "err", err)
-			}
-		} else {
-			defer vf.Close()
-			err = json.NewDecoder(vf).Decode(&cb.data)
-			if err != nil {
-				tlogger.Error("builder", "js", "msg", "Can't decode js vars file", "file", varsPath, "err", err)
-				return err
-			}
+			tlogger.Error("builder", "js", "msg", "Can't decode js vars file", "file", varsPath, "err", err)
+			return err
 		}
 	}
 
-	f, err := cb.ProcessAsByte(path, file)
+	f, lines, err := run.processLines(path, file)
 	if err != nil {
-		return err
+		return newBuildError("js", path, 0, err)
 	}
+	cb.builder.warnHiddenJSEnvRefs(path, f, lines, run.data)
 
-	of, err := os.OpenFile(filepath.Join(cb.builder.buildDir, path), os.O_CREATE|os.O_RDWR, 0644)
+	of, err := cb.builder.createOutput(path)
 	if err != nil {
 		tlogger.Error("builder", "js", "msg", "output file creation", "file", path, "err", err)
 		return err
 	}
-	defer of.Close()
-
-	wr := of
+	if cb.builder.opts.SourceMaps {
+		err = cb.builder.writeWithSourceMap(MediaTypeJS, path, of, f, lines)
+	} else {
+		wr := cb.builder.outputWriter(MediaTypeJS, of)
+		defer wr.Close()
+
+		_, err = wr.Write(f)
+		if err == nil {
+			err = wr.Close()
+		}
+	}
+	if err != nil {
+		tlogger.Error("builder", "js", "msg", "output file write", "file", path, "err", err)
+		return err
+	}
 
-	wr.Write(f)
-	wr.Close()
+	cb.builder.registerOutput(path, outputJS)
 
 	return nil
 }
@@ -109,19 +127,26 @@ func (cb *JSBuilder) GetInternal(path string) []byte {
 }
 
 func (cb *JSBuilder) ProcessAsByte(path string, file fs.FileInfo) ([]byte, error) {
+	f, _, err := cb.processLines(path, file)
+	return f, err
+}
+
+// processLines is ProcessAsByte keeping track of the source of every output line
+func (cb *JSBuilder) processLines(path string, file fs.FileInfo) ([]byte, []sourceLine, error) {
 	if cb.depth > 5 {
 		tlogger.Debug("builder", "js", "msg", "file error", "file", path, "err", "reached max recursion depth of 5, import loop ?")
-		return nil, ErrTooDeep
+		return nil, nil, ErrTooDeep
 	}
-	f, err := os.ReadFile(filepath.Join(cb.builder.srcDir, path))
+	f, err := cb.builder.readSource(path)
 	if err != nil {
 		tlogger.Error("builder", "js", "msg", "file error", "file", path, "err", err)
-		return nil, err
+		return nil, nil, err
 	}
 
 	f = replaceWindowsCarriageReturn(f)
 
-	f = JSBuilderImportRegexp.ReplaceAllFunc(f, func(match []byte) []byte {
+	var importErr error
+	f, lines := spliceImports(JSBuilderImportRegexp, path, f, func(match []byte, line int) ([]byte, []sourceLine) {
 		p := string(JSBuilderImportRegexp.FindSubmatch(match)[1])
 
 		// Split on /, check if begins by __internal, if so, load html vars, json
@@ -134,15 +159,20 @@ func (cb *JSBuilder) ProcessAsByte(path string, file fs.FileInfo) ([]byte, error
 
 		p = filepath.Join(cb.folder, p)
 
-		fileData, err := os.Stat(filepath.Join(cb.builder.srcDir, p))
+		// Registered first so the importer gets rebuilt when a missing file is created
+		cb.builder.addDep(p, path)
+
+		fileData, err := cb.builder.statSource(p)
 		if err != nil {
 			tlogger.Error("builder", "js", "msg", "file error import", "sourcefile", path, "expectedfile", p, "err", err)
-			return []byte{'\n'}
+			cb.builder.keepImportError(&importErr, "js", path, line, p, err)
+			return []byte{'\n'}, nil
 		}
 
 		if !cb.IsJsFile(p, fileData) {
-			tlogger.Error("builder", "js", "msg", "file error import", "sourcefile", path, "expectedfile", p, "err", "import types mismatched")
-			return []byte{'\n'}
+			tlogger.Error("builder", "js", "msg", "file error import", "sourcefile", path, "expectedfile", p, "err", ErrImportTypeMismatch)
+			cb.builder.keepImportError(&importErr, "js", path, line, p, ErrImportTypeMismatch)
+			return []byte{'\n'}, nil
 		}
 
 		nestedCB := &JSBuilder{
@@ -154,25 +184,23 @@ func (cb *JSBuilder) ProcessAsByte(path string, file fs.FileInfo) ([]byte, error
 			data:      cb.data,
 		}
 
-		if _, ok := cb.builder.fileDeps[p]; ok {
-			cb.builder.fileDeps[p][path] = struct{}{}
-		} else {
-			cb.builder.fileDeps[p] = map[string]struct{}{path: {}}
-		}
-
-		c, err := nestedCB.ProcessAsByte(p, fileData)
+		c, cLines, err := nestedCB.processLines(p, fileData)
 		if err != nil {
 			tlogger.Error("builder", "js", "msg", "file error process", "sourcefile", path, "expectedfile", p, "err", err)
-			return []byte{'\n'}
+			cb.builder.keepImportError(&importErr, "js", path, line, p, err)
+			return []byte{'\n'}, nil
 		}
-		if c[len(c)-1] != '\n' {
+		if len(c) == 0 || c[len(c)-1] != '\n' {
 			c = append(c, '\n')
 		}
 
-		return c
+		return c, cLines
 	})
+	if importErr != nil {
+		return nil, nil, importErr
+	}
 
-	f = JSBuilderImportHTMLVarsFuncRegexp.ReplaceAllFunc(f, func(match []byte) []byte {
+	f, lines = replaceMapped(JSBuilderImportHTMLVarsFuncRegexp, f, lines, func(match []byte) []byte {
 		p := string(JSBuilderImportHTMLVarsFuncRegexp.FindSubmatch(match)[1])
 
 		p = strings.Trim(p, "\"")
@@ -198,18 +226,18 @@ func (cb *JSBuilder) ProcessAsByte(path string, file fs.FileInfo) ([]byte, error
 		// return c
 	})
 
-	f = JSBuilderImportVarsFuncRegexp.ReplaceAllFunc(f, func(match []byte) []byte {
-		env := os.Environ()
-		for i := 0; i < len(env); i++ {
-			spl := strings.Split(env[i], "=")
-			if len(spl) == 2 {
-				cb.data[spl[0]] = spl[1]
-			}
+	f, lines = replaceMapped(JSBuilderImportVarsFuncRegexp, f, lines, func(match []byte) []byte {
+		data := make(map[string]interface{}, len(cb.data))
+		for k, v := range cb.data {
+			data[k] = v
 		}
 
-		jsm, _ := helpers.MarshalJson(cb.data)
+		cb.builder.addEnv(data)
+		cb.builder.addBuildEnv("js", path, data, "")
+
+		jsm, _ := helpers.MarshalJson(data)
 		return bytes.TrimRight(jsm, "\n ")
 	})
 
-	return f, nil
+	return f, lines, nil
 }
@@ -0,0 +1,242 @@
+package builder
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	htemplate "html/template"
+	"io/fs"
+	"path/filepath"
+	"strings"
+
+	"github.com/toastate/toastfront/internal/tlogger"
+	"github.com/toastate/toastfront/pkg/config"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/renderer/html"
+	"gopkg.in/yaml.v3"
+)
+
+var ErrMissingLayout = errors.New("markdown pages need a layout, set it in the front matter or in builder_config.markdown.layout")
+
+// MarkdownBuilder renders the Markdown files of the html directory to HTML pages,
+// the rendered Markdown fills the content block of the page layout
+type MarkdownBuilder struct {
+	builder *Builder
+
+	extension string
+	folder    string
+	layout    string // Used when the front matter doesn't set one
+}
+
+// markdownFrontMatter is the YAML header of a Markdown page, between two --- lines
+type markdownFrontMatter struct {
+	Title  string                 `yaml:"title"`
+	Layout string                 `yaml:"layout"`
+	Vars   map[string]interface{} `yaml:"vars"`
+}
+
+var markdown = goldmark.New(goldmark.WithRendererOptions(html.WithUnsafe()))
+
+func (mb *MarkdownBuilder) Init() error {
+	tlogger.Debug("builder", "markdown", "msg", "init")
+
+	mb.extension = ".md"
+	mb.folder = *mb.builder.htmlDirectory
+
+	if mdData, ok := config.Config.BuilderConfig["markdown"]; ok {
+		if data, ok := mdData["ext"]; ok {
+			mb.extension = data
+		}
+		if data, ok := mdData["layout"]; ok {
+			mb.layout = data
+		}
+	}
+
+	return nil
+}
+
+// CanHandle only claims the Markdown files with a layout, the other ones (README.md...) are copied as is
+func (mb *MarkdownBuilder) CanHandle(path string, file fs.FileInfo) bool {
+	if !mb.IsMarkdownFile(path, file) {
+		return false
+	}
+	if mb.hasLayout(path) {
+		return true
+	}
+
+	tlogger.Debug("builder", "markdown", "msg", "No layout, copied as is", "file", path)
+	return false
+}
+
+// hasLayout reports whether the page at path gets a layout from its front matter or from the configuration.
+// Pages with an invalid front matter are claimed so the error gets reported.
+func (mb *MarkdownBuilder) hasLayout(path string) bool {
+	if mb.layout != "" {
+		return true
+	}
+
+	src, err := mb.builder.readSource(path)
+	if err != nil {
+		return false
+	}
+	fm, _, _, err := parseFrontMatter(replaceWindowsCarriageReturn(src))
+	return err != nil || fm.Layout != ""
+}
+
+func (mb *MarkdownBuilder) IsMarkdownFile(path string, file fs.FileInfo) bool {
+	pathSplit := strings.Split(path, string(filepath.Separator))
+	if mb.folder != "" {
+		if pathSplit[0] != mb.folder {
+			return false
+		}
+	}
+	return !file.IsDir() && filepath.Ext(file.Name()) == mb.extension
+}
+
+func (mb *MarkdownBuilder) RewritePath(path string) string {
+	return mb.htmlBuilder().RewritePath(strings.TrimSuffix(path, mb.extension) + mb.htmlBuilder().extension)
+}
+
+func (mb *MarkdownBuilder) htmlBuilder() *HTMLBuilder {
+	return mb.builder.fileBuilders["html"].(*HTMLBuilder)
+}
+
+// markdownPage is a Markdown file ready to be rendered
+type markdownPage struct {
+	run      *HTMLBuilder
+	parts    []templatePart
+	front    markdownFrontMatter
+	rendered []byte
+	pathOut  string
+}
+
+func (mb *MarkdownBuilder) Process(path string, file fs.FileInfo) error {
+	tlogger.Debug("builder", "markdown", "msg", "processing", "file", path)
+
+	page, err := mb.loadPage(path)
+	if err != nil {
+		return err
+	}
+
+	of, err := mb.builder.createOutput(page.pathOut)
+	if err != nil {
+		tlogger.Error("builder", "markdown", "msg", "output file creation", "file", page.pathOut, "err", err)
+		return err
+	}
+	wr := mb.builder.outputWriter(MediaTypeHTML, of)
+	defer wr.Close()
+
+	data := page.data()
+	mb.builder.warnHiddenEnvRefs("markdown", page.parts, htmlActionRegexp, data)
+	err = executeTemplate(wr, `<!--#`, `-->`, page.parts, page.funcs(data), data)
+	if err != nil {
+		tlogger.Error("builder", "markdown", "msg", "templater", "file", path, "err", err)
+		return templateError("markdown", path, err, page.parts)
+	}
+
+	err = wr.Close()
+	if err != nil {
+		tlogger.Error("builder", "markdown", "msg", "output file write", "file", page.pathOut, "err", err)
+		return err
+	}
+
+	mb.builder.registerOutput(page.pathOut, outputHTML)
+
+	return nil
+}
+
+// loadPage reads and renders the Markdown file at path and resolves its layouts
+func (mb *MarkdownBuilder) loadPage(path string) (*markdownPage, error) {
+	src, err := mb.builder.readSource(path)
+	if err != nil {
+		tlogger.Error("builder", "markdown", "msg", "file error", "file", path, "err", err)
+		return nil, err
+	}
+	src = replaceWindowsCarriageReturn(src)
+
+	fm, body, bodyLine, err := parseFrontMatter(src)
+	if err != nil {
+		tlogger.Error("builder", "markdown", "msg", "front matter", "file", path, "err", err)
+		return nil, newBuildError("markdown", path, 1, err)
+	}
+
+	rendered := &bytes.Buffer{}
+	err = markdown.Convert(body, rendered)
+	if err != nil {
+		tlogger.Error("builder", "markdown", "msg", "markdown rendering", "file", path, "err", err)
+		return nil, newBuildError("markdown", path, bodyLine, err)
+	}
+
+	layout := fm.Layout
+	if layout == "" {
+		layout = mb.layout
+	}
+	if layout == "" {
+		return nil, newBuildError("markdown", path, 1, ErrMissingLayout)
+	}
+
+	run, err := mb.htmlBuilder().newRun()
+	if err != nil {
+		return nil, err
+	}
+
+	// The page is a template filling the content block of its layout with the rendered Markdown
+	content := []byte("<!--#layout " + layout + "-->\n<!--#define \"content\"--><!--#toastfrontMarkdown--><!--#end-->\n")
+	lines := []sourceLine{{File: path, Line: 1}, {File: path, Line: bodyLine}}
+
+	parts, err := run.layoutParts(path, content, lines)
+	if err != nil {
+		return nil, newBuildError("markdown", path, 0, err)
+	}
+
+	return &markdownPage{
+		run:      run,
+		parts:    parts,
+		front:    fm,
+		rendered: rendered.Bytes(),
+		pathOut:  mb.RewritePath(path),
+	}, nil
+}
+
+// data returns the page vars, overridden by the front matter
+func (p *markdownPage) data() map[string]interface{} {
+	data := p.run.GetPathData(p.pathOut)
+	for k, v := range p.front.Vars {
+		data[k] = v
+	}
+	if p.front.Title != "" {
+		data["title"] = p.front.Title
+	}
+	return data
+}
+
+func (p *markdownPage) funcs(data map[string]interface{}) map[string]interface{} {
+	funcs := p.run.builder.pageFuncs(p.run, p.pathOut, data)
+	funcs["toastfrontMarkdown"] = func() htemplate.HTML {
+		return htemplate.HTML(p.rendered)
+	}
+	return funcs
+}
+
+// parseFrontMatter splits the optional YAML front matter from the Markdown body,
+// bodyLine is the line of the source the body starts at
+func parseFrontMatter(src []byte) (fm markdownFrontMatter, body []byte, bodyLine int, err error) {
+	lines := bytes.SplitAfter(src, []byte{'\n'})
+	if len(lines) == 0 || string(lines[0]) != "---\n" {
+		return fm, src, 1, nil
+	}
+
+	for i := 1; i < len(lines); i++ {
+		if strings.TrimSuffix(string(lines[i]), "\n") != "---" {
+			continue
+		}
+
+		err = yaml.Unmarshal(bytes.Join(lines[1:i], nil), &fm)
+		if err != nil {
+			return fm, nil, 0, fmt.Errorf("invalid front matter: %v", err)
+		}
+		return fm, bytes.Join(lines[i+1:], nil), i + 2, nil
+	}
+
+	return fm, nil, 0, errors.New("front matter isn't closed by a --- line")
+}
@@ -2,11 +2,14 @@ package builder
 
 import (
 	"errors"
+	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
-	"time"
+	"sync"
 
 	"github.com/toastate/toastfront/internal/tlogger"
 	"github.com/toastate/toastfront/pkg/config"
@@ -23,7 +26,7 @@ func (b *Builder) Init() error {
 	}
 
 	if b.currentLanguage == "" {
-		b.currentLanguage = config.Config.RootLanguage
+		b.currentLanguage = config.Config.ResolvedRootLanguage()
 	}
 
 	if b.buildDir == "" {
@@ -32,20 +35,29 @@ func (b *Builder) Init() error {
 	if b.srcDir == "" {
 		b.srcDir = filepath.Join(b.rootFolder, config.Config.SrcDir)
 	}
+	if b.siteDir == "" {
+		b.siteDir = b.buildDir
+	}
 
 	if b.fileDeps == nil {
 		b.fileDeps = make(map[string]map[string]struct{})
 	}
 
-	if _, err := os.Stat(b.srcDir); os.IsNotExist(err) {
-		tlogger.Error("msg", "Src folder not found", "path", b.srcDir, "err", err)
-		return errors.New("src folder not found")
+	if b.src == nil {
+		if _, err := os.Stat(b.srcDir); os.IsNotExist(err) {
+			tlogger.Error("msg", "Src folder not found", "path", b.srcDir, "err", err)
+			return errors.New("src folder not found")
+		}
+		b.src = os.DirFS(b.srcDir)
+	}
+	if b.output == nil {
+		b.output = NewDirOutput(b.siteDir)
 	}
 
 	if b.htmlDirectory == nil {
 		if config.Config.HTMLDir != "." {
 			if config.Config.HTMLDir == "" { // Auto detect
-				if f, _ := os.Stat(filepath.Join(b.srcDir, "html")); f != nil && f.IsDir() {
+				if f, _ := b.statSource("html"); f != nil && f.IsDir() {
 					a := "html"
 					b.htmlDirectory = &a
 				}
@@ -67,59 +79,26 @@ func (b *Builder) Init() error {
 		}
 	}
 
-	b.fileBuilders = map[string]FileBuilder{
-		"folder": &FolderBuilder{builder: b},
-		"css":    &CSSBuilder{builder: b},
-		"html":   &HTMLBuilder{builder: b},
-		"js":     &JSBuilder{builder: b},
-		// "vendor": &VendorBuilder{builder: b},
-		"copy": &CopyBuilder{builder: b},
-	}
-	b.fileBuildersArray = []FileBuilder{
-		b.fileBuilders["folder"],
-		b.fileBuilders["css"],
-		b.fileBuilders["html"],
-		b.fileBuilders["js"],
-		b.fileBuilders["copy"],
+	b.initFileBuilders()
+
+	err := b.loadEnv()
+	if err != nil {
+		return err
 	}
 
 	if len(b.subBuilders) > 0 {
 		for _, v := range b.subBuilders {
 			v.Init()
 		}
-	} else if !b.isSubBuilder && len(config.Config.Languages) > 1 {
-		buildDir := b.buildDir
-		b.subBuilders = map[string]*Builder{}
-		i := 0
-		if config.Config.RootLanguage == "" {
-			b.currentLanguage = config.Config.Languages[0]
-			b.buildDir = filepath.Join(buildDir, b.currentLanguage)
-			i++
-		}
-		for ; i < len(config.Config.Languages); i++ {
-			lg := config.Config.Languages[i]
-			if lg == b.currentLanguage {
-				continue
-			}
-			subBuilder := &Builder{
-				rootFolder:      b.rootFolder,
-				htmlDirectory:   b.htmlDirectory,
-				varsDirectory:   b.varsDirectory,
-				currentLanguage: lg,
-				srcDir:          b.srcDir,
-				buildDir:        filepath.Join(buildDir, lg),
-				isSubBuilder:    true,
-			}
-			err := subBuilder.Init()
-			if err != nil {
-				return err
-			}
-			b.subBuilders[lg] = subBuilder
+	} else if !b.isSubBuilder {
+		err := b.initLanguages()
+		if err != nil {
+			return err
 		}
 	}
 
 	for _, v := range b.fileBuildersArray {
-		err := v.Init()
+		err := v.fb.Init()
 		if err != nil {
 			return err
 		}
@@ -129,6 +108,61 @@ func (b *Builder) Init() error {
 	return nil
 }
 
+// initLanguages lays out the build directory according to the language mode,
+// creating a sub builder for every language other than the root one
+func (b *Builder) initLanguages() error {
+	b.languageMode = config.Config.ResolvedLanguageMode()
+
+	switch b.languageMode {
+	case config.LanguageModeUnique:
+		if len(config.Config.Languages) > 1 {
+			tlogger.Info("msg", "Unique language mode, only the root language is built", "language", b.currentLanguage)
+		}
+		return nil
+	case config.LanguageModeFolder:
+		b.buildDir = filepath.Join(b.siteDir, b.currentLanguage)
+		b.outputDir = b.currentLanguage
+	case config.LanguageModeSubfolder:
+	default:
+		tlogger.Error("msg", "Unknown language mode", "language_mode", b.languageMode)
+		return fmt.Errorf("unknown language mode %q, expected one of %s, %s or %s", b.languageMode, config.LanguageModeUnique, config.LanguageModeSubfolder, config.LanguageModeFolder)
+	}
+
+	b.subBuilders = map[string]*Builder{}
+	for _, lg := range config.Config.Languages {
+		if lg == b.currentLanguage {
+			continue
+		}
+		subBuilder := &Builder{
+			rootFolder:      b.rootFolder,
+			htmlDirectory:   b.htmlDirectory,
+			varsDirectory:   b.varsDirectory,
+			currentLanguage: lg,
+			srcDir:          b.srcDir,
+			buildDir:        filepath.Join(b.siteDir, lg),
+			siteDir:         b.siteDir,
+			src:             b.src,
+			output:          b.output,
+			outputDir:       lg,
+			languageMode:    b.languageMode,
+			registrations:   b.registrations,
+			isSubBuilder:    true,
+		}
+		err := subBuilder.Init()
+		if err != nil {
+			return err
+		}
+		b.subBuilders[lg] = subBuilder
+	}
+
+	return nil
+}
+
+// LanguageMode returns the language layout of the build directory, see config.ResolvedLanguageMode
+func (b *Builder) LanguageMode() string {
+	return b.languageMode
+}
+
 func (b *Builder) ShouldHandle(name string) bool {
 	folderList := strings.Split(name, string(filepath.Separator))
 	for _, v := range folderList {
@@ -146,71 +180,191 @@ func (b *Builder) Build(opts ...*BuilderOpts) error {
 	if len(opts) > 0 {
 		b.opts = opts[0]
 	}
+	if b.opts == nil {
+		b.opts = &BuilderOpts{}
+	}
 
-	err := os.RemoveAll(b.buildDir)
-	if err != nil {
-		<-time.After(time.Millisecond * 20)
-		err = os.RemoveAll(b.buildDir)
+	b.resetDiagnostics()
+	defer b.logDiagnosticsSummary()
+
+	if b.opts.StrictI18n {
+		err := b.checkStrictTranslations()
 		if err != nil {
-			<-time.After(time.Millisecond * 20)
-			err = os.RemoveAll(b.buildDir)
-			tlogger.Error("msg", "Failed to remove build folder", "path", b.buildDir, "err", err)
+			return err
 		}
 	}
 
-	err = os.MkdirAll(b.buildDir, 0755)
+	// The .env files may have changed since the previous build
+	err := b.loadEnv()
+	if err != nil {
+		return err
+	}
+
+	// Staged outputs keep the previous build until this one succeeds
+	staged, isStaged := b.output.(StagedOutput)
+	if isStaged {
+		err = staged.Stage()
+	} else {
+		err = b.output.Clear()
+	}
+	if err != nil {
+		tlogger.Error("msg", "Failed to prepare build output", "path", b.siteDir, "err", err)
+		return err
+	}
+
+	err = b.output.MkdirAll(b.outputName(""))
 	if err != nil {
 		tlogger.Error("msg", "Failed to create build folder", "path", b.buildDir, "err", err)
+		if isStaged {
+			staged.Discard()
+		}
 		return err
 	}
 
 	tlogger.Info("msg", "Building started", "path", b.srcDir)
 	defer tlogger.Info("msg", "Building finished", "path", b.srcDir)
 
-	err = filepath.Walk(b.srcDir, func(absolutepath string, info fs.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
+	b.fileDeps = make(map[string]map[string]struct{})
+	b.outputs = nil
+	b.sourceOutputs = nil
+	b.pages = nil
+	b.resetMinifyStats()
+	for _, subBuilder := range b.subBuilders {
+		subBuilder.opts = b.opts
+		subBuilder.env, subBuilder.hiddenEnv = b.env, b.hiddenEnv
+		subBuilder.fileDeps = make(map[string]map[string]struct{})
+		subBuilder.outputs = nil
+		subBuilder.sourceOutputs = nil
+		subBuilder.pages = nil
+		subBuilder.resetMinifyStats()
+	}
 
-		path, err := filepath.Rel(b.srcDir, absolutepath)
-		if err != nil {
-			tlogger.Error("msg", "Failed to get relative path", "path", path, "err", err)
-			return err
-		}
+	builders := []*Builder{b}
+	for _, lg := range b.subBuilderLanguages() {
+		builders = append(builders, b.subBuilders[lg])
+	}
 
-		if b.ShouldHandle(path) {
-			for _, v := range b.fileBuildersArray {
-				if v.CanHandle(path, info) {
-					err = v.Process(path, info)
-					if err != nil {
-						tlogger.Error("msg", "Error processing file", "path", path, "error", err)
-						return err
-					}
+	jobs := b.opts.Jobs
+	if jobs <= 0 {
+		jobs = runtime.NumCPU()
+	}
+
+	tasks := make(chan buildTask)
+	failed := make(chan struct{})
+	var failOnce sync.Once
 
-					break
+	wg := sync.WaitGroup{}
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range tasks {
+				err := t.builder.processFile(t.path, t.info)
+				if err != nil && !b.opts.KeepGoing {
+					failOnce.Do(func() {
+						close(failed)
+					})
 				}
 			}
-		}
+		}()
+	}
 
-		for _, subBuilder := range b.subBuilders {
-			for _, v := range subBuilder.fileBuildersArray {
-				if v.CanHandle(path, info) {
-					err = v.Process(path, info)
-					if err != nil {
-						tlogger.Error("msg", "Error processing file", "path", path, "error", err)
-						return err
-					}
+	err = b.walkSource(".", func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
 
-					break
+		for _, bd := range builders {
+			// Folders are created right away so they exist before the files they contain get processed
+			if info.IsDir() {
+				err = bd.processFile(path, info)
+				if err != nil && !b.opts.KeepGoing {
+					return errBuildStopped
 				}
+				continue
+			}
+
+			select {
+			case tasks <- buildTask{builder: bd, path: path, info: info}:
+			case <-failed:
+				return errBuildStopped
 			}
 		}
 		return nil
 	})
 
+	close(tasks)
+	wg.Wait()
+
+	// The errors of every failed file are returned, unless the walk itself failed
+	if err == nil || err == errBuildStopped {
+		err = b.diagnostics.err()
+	}
+
+	if err == nil && b.opts.HashAssets {
+		err = b.hashAssets()
+	}
+	if err == nil && b.opts.Sitemap {
+		err = b.writeSitemap()
+	}
+
+	if isStaged {
+		if err == nil {
+			err = staged.Commit()
+			if err != nil {
+				tlogger.Error("msg", "Failed to replace the previous build", "path", b.siteDir, "err", err)
+			}
+		} else {
+			staged.Discard()
+			tlogger.Error("msg", "Build failed, the previous build was kept", "path", b.siteDir)
+		}
+	}
+
+	b.built = err == nil
+	if err == nil {
+		b.logMinifySummary()
+	}
 	return err
 }
 
+// subBuilderLanguages returns the languages handled by sub builders in a stable order
+func (b *Builder) subBuilderLanguages() []string {
+	out := make([]string, 0, len(b.subBuilders))
+	for lg := range b.subBuilders {
+		out = append(out, lg)
+	}
+	sort.Strings(out)
+	return out
+}
+
+type buildTask struct {
+	builder *Builder
+	path    string
+	info    fs.FileInfo
+}
+
+func (b *Builder) processFile(path string, info fs.FileInfo) error {
+	if !b.ShouldHandle(path) {
+		return nil
+	}
+
+	for _, v := range b.fileBuildersArray {
+		if v.fb.CanHandle(path, info) {
+			err := v.fb.Process(path, info)
+			if err != nil {
+				be := newBuildError(v.name, path, 0, err)
+				tlogger.Error("msg", "Error processing file", "path", path, "error", be)
+				b.diagnostics.error(be)
+				return be
+			}
+
+			b.registerSource(path, v.fb)
+			break
+		}
+	}
+	return nil
+}
+
 func (b *Builder) BuildSingle(path string, info fs.FileInfo) error {
 	if b.ShouldHandle(path) {
 		for k, v := range b.fileBuilders {
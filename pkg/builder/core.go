@@ -2,16 +2,28 @@ package builder
 
 import (
 	"io/fs"
+	"sync"
 )
 
 type Builder struct {
 	opts *BuilderOpts
 
 	initialized bool
+	built       bool // A full build completed, incremental builds can rely on fileDeps
 
 	rootFolder string
 	buildDir   string
 	srcDir     string
+	siteDir    string // Top of the build directory, holding every language
+
+	src       fs.FS  // Defaults to srcDir
+	output    Output // Defaults to a DirOutput of siteDir
+	outputDir string // Folder of the language in output, empty for the root language
+
+	languageMode string
+
+	env       map[string]string   // Environment variables exposed to the templates
+	hiddenEnv map[string]struct{} // Names of the other environment variables, to warn when they are used
 
 	currentLanguage string
 
@@ -19,15 +31,34 @@ type Builder struct {
 	varsDirectory *string
 
 	fileBuilders      map[string]FileBuilder
-	fileBuildersArray []FileBuilder
+	fileBuildersArray []namedFileBuilder // By priority
+	registrations     []fileBuilderRegistration
 
+	depsMu   sync.Mutex
 	fileDeps map[string]map[string]struct{}
 
+	minifyStats map[string]*minifyStat // Indexed by media type
+	diagnostics *diagnostics           // Shared by every language
+
+	outputsMu     sync.Mutex
+	outputs       map[string]outputKind // Generated files, only tracked when hashing assets
+	assetManifest map[string]string     // Logical to hashed path
+	sourceOutputs map[string]string     // Source to output path, to remove the outputs of deleted sources
+	pages         map[string]struct{}   // Output paths of the HTML pages, for the sitemap
+
 	isSubBuilder bool
 	subBuilders  map[string]*Builder // Used in multi lang scenarios
 }
 
 type BuilderOpts struct {
+	Minify     bool     // Pipe HTML, CSS and JS outputs through the minifier
+	MinifySkip []string // Types left untouched when minifying: html, css or js
+	HashAssets bool     // Add a content hash to JS, CSS and copied file names and write an asset manifest
+	SourceMaps bool     // Write a source map next to every JS and CSS output
+	Jobs       int      // Files processed concurrently, defaults to the number of CPUs
+	Sitemap    bool     // Write sitemap.xml, with the alternate languages of every page
+	StrictI18n bool     // Fail the build on missing translations, see CheckTranslations
+	KeepGoing  bool     // Build every file even after errors, the build still fails
 }
 
 func NewBuilder(srcDir, buildDir, rootFolder string) *Builder {
@@ -38,17 +69,68 @@ func NewBuilder(srcDir, buildDir, rootFolder string) *Builder {
 	}
 }
 
+// NewBuilderFS builds the src tree into out, such as an embed.FS into a MemoryOutput.
+// A nil src or out defaults to the source or build directory of the configuration.
+func NewBuilderFS(src fs.FS, out Output, rootFolder string) *Builder {
+	return &Builder{
+		src:        src,
+		output:     out,
+		rootFolder: rootFolder,
+	}
+}
+
+// SetOutput replaces the build directory by out, it must be called before Init
+func (b *Builder) SetOutput(out Output) error {
+	if b.initialized {
+		return ErrAlreadyInitialized
+	}
+	b.output = out
+	return nil
+}
+
+// Output returns the output the builder writes to
+func (b *Builder) Output() Output {
+	return b.output
+}
+
 func (b *Builder) BuildDir() string {
 	return b.buildDir
 }
 
+// BuildEnv describes the language being built, templates get it as the toastfront var
 type BuildEnv struct {
 	Lang           string
+	AvailableLangs []string // Root language first
+	RootLang       string
+	URLs           map[string]string // URL of the current page in every language, of the language home page for CSS and JS
+
+	// Deprecated: use AvailableLangs, AvaliableLangs holds the same languages
 	AvaliableLangs []string
 }
 
+// Vars returns the env as template vars:
+// toastfront.lang, toastfront.languages, toastfront.root_lang and toastfront.urls
+func (e BuildEnv) Vars() map[string]interface{} {
+	languages := e.AvailableLangs
+	if languages == nil {
+		languages = e.AvaliableLangs
+	}
+	return map[string]interface{}{
+		"lang":      e.Lang,
+		"languages": languages,
+		"root_lang": e.RootLang,
+		"urls":      e.URLs,
+	}
+}
+
 type FileBuilder interface {
 	Init() error
 	CanHandle(string, fs.FileInfo) bool
 	Process(string, fs.FileInfo) error
 }
+
+// pathRewriter is implemented by the file builders whose output path differs from the source path.
+// An empty path means no output is generated.
+type pathRewriter interface {
+	RewritePath(string) string
+}
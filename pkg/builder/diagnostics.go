@@ -0,0 +1,163 @@
+package builder
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/toastate/toastfront/internal/tlogger"
+)
+
+// Diagnostic is an error or a warning reported by a build
+type Diagnostic struct {
+	Builder string `json:"builder,omitempty"`
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Message string `json:"message"`
+	Warning bool   `json:"warning,omitempty"`
+}
+
+func (d Diagnostic) String() string {
+	out := ""
+	if d.Builder != "" {
+		out += d.Builder + ": "
+	}
+	if d.File != "" {
+		out += d.File
+		if d.Line > 0 {
+			out += ":" + strconv.Itoa(d.Line)
+		}
+		out += ": "
+	}
+	return out + d.Message
+}
+
+// BuildErrors is returned by Build when files failed to build, it unwraps to the first error
+type BuildErrors []*BuildError
+
+func (e BuildErrors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", e[0].Error(), len(e)-1)
+}
+
+func (e BuildErrors) Unwrap() error {
+	return e[0]
+}
+
+// diagnostics collects the errors and warnings of a build, it is shared by the builders of every language.
+// The same issue reported by several languages is only kept once. A nil diagnostics discards everything,
+// for files processed outside of a build.
+type diagnostics struct {
+	mu     sync.Mutex
+	items  []Diagnostic
+	errors []*BuildError
+	seen   map[Diagnostic]struct{}
+}
+
+func newDiagnostics() *diagnostics {
+	return &diagnostics{seen: map[Diagnostic]struct{}{}}
+}
+
+func (d *diagnostics) add(diag Diagnostic) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.seen[diag]; ok {
+		return false
+	}
+	d.seen[diag] = struct{}{}
+	d.items = append(d.items, diag)
+	return true
+}
+
+func (d *diagnostics) error(be *BuildError) {
+	if d == nil {
+		return
+	}
+	if d.add(Diagnostic{Builder: be.Builder, File: be.File, Line: be.Line, Message: be.Message}) {
+		d.mu.Lock()
+		d.errors = append(d.errors, be)
+		d.mu.Unlock()
+	}
+}
+
+func (d *diagnostics) warn(builder, file string, line int, message string) {
+	if d == nil {
+		return
+	}
+	d.add(Diagnostic{Builder: builder, File: file, Line: line, Message: message, Warning: true})
+}
+
+// err returns the errors reported so far, nil if there are none
+func (d *diagnostics) err() error {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.errors) == 0 {
+		return nil
+	}
+
+	out := append(BuildErrors{}, d.errors...)
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].File != out[j].File {
+			return out[i].File < out[j].File
+		}
+		return out[i].Line < out[j].Line
+	})
+	return out
+}
+
+// list returns the diagnostics sorted by file and line
+func (d *diagnostics) list() []Diagnostic {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	out := append([]Diagnostic{}, d.items...)
+	d.mu.Unlock()
+
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].File != out[j].File {
+			return out[i].File < out[j].File
+		}
+		return out[i].Line < out[j].Line
+	})
+	return out
+}
+
+// Diagnostics returns the errors and warnings of the last build, sorted by file and line
+func (b *Builder) Diagnostics() []Diagnostic {
+	return b.diagnostics.list()
+}
+
+// resetDiagnostics starts collecting the diagnostics of a new build
+func (b *Builder) resetDiagnostics() {
+	b.diagnostics = newDiagnostics()
+	for _, subBuilder := range b.subBuilders {
+		subBuilder.diagnostics = b.diagnostics
+	}
+}
+
+// logDiagnosticsSummary logs the number of errors and warnings of the build
+func (b *Builder) logDiagnosticsSummary() {
+	errorCount, warningCount := 0, 0
+	for _, d := range b.diagnostics.list() {
+		if d.Warning {
+			warningCount++
+		} else {
+			errorCount++
+		}
+	}
+
+	if errorCount > 0 {
+		tlogger.Error("msg", "Build failed", "errors", errorCount, "warnings", warningCount)
+	} else if warningCount > 0 {
+		tlogger.Warn("msg", "Build finished with warnings", "warnings", warningCount)
+	}
+}
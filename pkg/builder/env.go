@@ -0,0 +1,139 @@
+package builder
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/toastate/toastfront/internal/tlogger"
+	"github.com/toastate/toastfront/pkg/config"
+)
+
+// Template actions of the HTML and markdown pages, and of the stylesheets
+var htmlActionRegexp = regexp.MustCompile(`(?s)<!--#(.*?)-->`)
+var cssActionRegexp = regexp.MustCompile(`(?s)"\{\{(.*?)\}\}"`)
+
+// Field references inside template actions, such as .NAME or $.NAME
+var templateEnvRefRegexp = regexp.MustCompile(`(?:^|[\s(|$])\.([A-Za-z_][A-Za-z0-9_]*)`)
+
+// Property accesses of the JS code, such as vars.NAME or vars["NAME"]
+var jsEnvRefRegexp = regexp.MustCompile(`\.([A-Za-z_][A-Za-z0-9_]*)\b|\[\s*["']([A-Za-z_][A-Za-z0-9_]*)["']\s*\]`)
+
+// loadEnv reads the environment variables of the .env files and of the process,
+// only the ones allowed by the env configuration are exposed to the templates
+func (b *Builder) loadEnv() error {
+	all := map[string]string{}
+	for _, f := range b.EnvFiles() {
+		vars, err := config.ReadEnvFile(f)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			tlogger.Error("msg", "Can't read env file", "file", f, "err", err)
+			return err
+		}
+		for k, v := range vars {
+			all[k] = v
+		}
+	}
+
+	// The process environment overrides the .env files
+	for _, kv := range os.Environ() {
+		spl := strings.SplitN(kv, "=", 2)
+		if len(spl) == 2 {
+			all[spl[0]] = spl[1]
+		}
+	}
+
+	b.env = map[string]string{}
+	b.hiddenEnv = map[string]struct{}{}
+	for k, v := range all {
+		if config.Config.Env.Exposes(k) {
+			b.env[k] = v
+		} else {
+			b.hiddenEnv[k] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// EnvFiles returns the absolute paths of the .env files read by the builds
+func (b *Builder) EnvFiles() []string {
+	files := config.Config.Env.ResolvedFiles()
+	out := make([]string, 0, len(files))
+	for _, f := range files {
+		if !filepath.IsAbs(f) {
+			f = filepath.Join(b.rootFolder, f)
+		}
+		if abs, err := filepath.Abs(f); err == nil {
+			f = abs
+		}
+		out = append(out, f)
+	}
+	return out
+}
+
+// isEnvFile reports whether path, as reported by the watcher, is one of the .env files
+func (b *Builder) isEnvFile(path string) bool {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	for _, f := range b.EnvFiles() {
+		if f == abs {
+			return true
+		}
+	}
+	return false
+}
+
+// addEnv adds the exposed environment variables to the template data
+func (b *Builder) addEnv(data map[string]interface{}) {
+	for k, v := range b.env {
+		data[k] = v
+	}
+}
+
+// warnHiddenEnvRefs warns about the template actions of parts, matched by actions, using an environment variable that isn't exposed
+func (b *Builder) warnHiddenEnvRefs(builder string, parts []templatePart, actions *regexp.Regexp, data map[string]interface{}) {
+	warned := map[string]struct{}{}
+
+	for _, part := range parts {
+		for _, action := range actions.FindAllSubmatchIndex(part.content, -1) {
+			start := action[2]
+			for _, ref := range templateEnvRefRegexp.FindAllSubmatchIndex(part.content[start:action[3]], -1) {
+				name := string(part.content[start+ref[2] : start+ref[3]])
+				b.warnHiddenEnv(builder, name, lineOrigin(part.name, part.content, part.lines, start+ref[2]), data, warned)
+			}
+		}
+	}
+}
+
+// warnHiddenJSEnvRefs warns about the properties of a JS output named like an environment variable that isn't exposed
+func (b *Builder) warnHiddenJSEnvRefs(path string, content []byte, lines []sourceLine, data map[string]interface{}) {
+	warned := map[string]struct{}{}
+	for _, ref := range jsEnvRefRegexp.FindAllSubmatchIndex(content, -1) {
+		start, end := ref[2], ref[3]
+		if start < 0 {
+			start, end = ref[4], ref[5]
+		}
+		b.warnHiddenEnv("js", string(content[start:end]), lineOrigin(path, content, lines, start), data, warned)
+	}
+}
+
+func (b *Builder) warnHiddenEnv(builder, name string, origin sourceLine, data map[string]interface{}, warned map[string]struct{}) {
+	if _, ok := b.hiddenEnv[name]; !ok {
+		return
+	}
+	if _, ok := data[name]; ok {
+		return
+	}
+	if _, ok := warned[name]; ok {
+		return
+	}
+	warned[name] = struct{}{}
+
+	tlogger.Warn("builder", builder, "msg", "Environment variable not exposed to the build, add it to env.allow or use an env.prefixes prefix", "var", name, "file", origin.File, "line", origin.Line)
+	b.diagnostics.warn(builder, origin.File, origin.Line, "environment variable "+name+" isn't exposed to the build")
+}
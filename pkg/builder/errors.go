@@ -1,5 +1,101 @@
 package builder
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+)
 
 var ErrTooDeep = errors.New("too deep")
+
+// errBuildStopped stops the source walk once a file failed to build
+var errBuildStopped = errors.New("build stopped")
+
+// BuildError locates an error in the source tree
+type BuildError struct {
+	Builder string `json:"builder"`
+	File    string `json:"file"`
+	Line    int    `json:"line,omitempty"`
+	Message string `json:"message"`
+
+	Err error `json:"-"`
+}
+
+func (e *BuildError) Error() string {
+	loc := e.File
+	if e.Line > 0 {
+		loc += ":" + strconv.Itoa(e.Line)
+	}
+	return fmt.Sprintf("%s: %s: %s", e.Builder, loc, e.Message)
+}
+
+func (e *BuildError) Unwrap() error {
+	return e.Err
+}
+
+func newBuildError(builder, file string, line int, err error) *BuildError {
+	var be *BuildError
+	if errors.As(err, &be) {
+		return be
+	}
+
+	return &BuildError{
+		Builder: builder,
+		File:    file,
+		Line:    line,
+		Message: err.Error(),
+		Err:     err,
+	}
+}
+
+var templateErrorRegexp = regexp.MustCompile(`(?s)^(?:html/)?template: ?(.+?):(\d+)(?::\d+)?: (.*)$`)
+
+// templateError locates a text/template or html/template error,
+// the lines of the parts map the template lines back to the files they were imported from
+func templateError(builder, file string, err error, parts []templatePart) *BuildError {
+	be := newBuildError(builder, file, 0, err)
+
+	m := templateErrorRegexp.FindStringSubmatch(err.Error())
+	if m == nil {
+		return be
+	}
+
+	be.Message = m[3]
+	be.Line, _ = strconv.Atoi(m[2])
+	for _, part := range parts {
+		if part.name != m[1] {
+			continue
+		}
+		be.File = part.name
+		if be.Line > 0 && be.Line <= len(part.lines) && part.lines[be.Line-1].File != "" {
+			be.File = part.lines[be.Line-1].File
+			be.Line = part.lines[be.Line-1].Line
+		}
+	}
+
+	return be
+}
+
+var ErrImportTypeMismatch = errors.New("import types mismatched")
+
+// keepImportError records in dst the first import error of a file, which fails it, the next ones are reported to the
+// build diagnostics. Errors coming from nested imports are kept as is since they are more precise.
+func (b *Builder) keepImportError(dst *error, builder, file string, line int, imported string, err error) {
+	var be *BuildError
+	if !errors.As(err, &be) {
+		be = &BuildError{
+			Builder: builder,
+			File:    file,
+			Line:    line,
+			Message: fmt.Sprintf("import %s: %v", imported, err),
+			Err:     err,
+		}
+	}
+
+	if *dst == nil {
+		*dst = be
+		return
+	}
+	b.diagnostics.error(be)
+}
@@ -0,0 +1,636 @@
+package builder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	htemplate "html/template"
+	"math"
+	"strconv"
+	"strings"
+	ttemplate "text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/toastate/toastfront/internal/tlogger"
+)
+
+// templateFuncs returns the function library of the HTML and CSS templates, bound to the language of the builder.
+// data is the template data, the one t looks the translations up in.
+// Functions taking a string last can be used at the end of a pipeline, such as <!--#.name | truncate 20-->.
+func (b *Builder) templateFuncs(data map[string]interface{}) map[string]interface{} {
+	lang := b.currentLanguage
+	return map[string]interface{}{
+		"plural": func(n interface{}, forms ...interface{}) (string, error) {
+			return plural(lang, n, forms...)
+		},
+		"pluralCategory": func(n interface{}) (string, error) {
+			ops, err := pluralOperandsOf(n)
+			return pluralCategory(lang, ops), err
+		},
+		"formatNumber": func(n interface{}, decimals ...int) (string, error) {
+			return formatNumber(lang, n, decimals...)
+		},
+		"formatDate": func(date interface{}, style ...string) (string, error) {
+			return formatDate(lang, date, style...)
+		},
+		"t": func(key string, args ...interface{}) (string, error) {
+			return translate(data, key, args...)
+		},
+
+		"upper": strings.ToUpper,
+		"lower": strings.ToLower,
+		"title": titleCase,
+		"trim":  strings.TrimSpace,
+		"replace": func(old, new, s string) string {
+			return strings.ReplaceAll(s, old, new)
+		},
+		"truncate": truncate,
+		"contains": func(substr, s string) bool {
+			return strings.Contains(s, substr)
+		},
+		"hasPrefix": func(prefix, s string) bool {
+			return strings.HasPrefix(s, prefix)
+		},
+		"hasSuffix": func(suffix, s string) bool {
+			return strings.HasSuffix(s, suffix)
+		},
+		"split": func(sep, s string) []string {
+			return strings.Split(s, sep)
+		},
+		"join": join,
+
+		"json":    toJSON,
+		"default": defaultValue,
+	}
+}
+
+var ErrNotANumber = errors.New("not a number")
+
+// toFloat converts the numbers of the vars files (float64), of the templates (int) and numeric strings
+func toFloat(n interface{}) (float64, error) {
+	switch v := n.(type) {
+	case int:
+		return float64(v), nil
+	case int8:
+		return float64(v), nil
+	case int16:
+		return float64(v), nil
+	case int32:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case uint:
+		return float64(v), nil
+	case uint8:
+		return float64(v), nil
+	case uint16:
+		return float64(v), nil
+	case uint32:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	case float32:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case json.Number:
+		return v.Float64()
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %q", ErrNotANumber, v)
+		}
+		return f, nil
+	}
+	return 0, fmt.Errorf("%w: %v", ErrNotANumber, n)
+}
+
+// pluralOperands are the CLDR plural operands: n the absolute value, i its integer digits and v its number of visible fraction digits
+type pluralOperands struct {
+	n float64
+	i int64
+	v int
+}
+
+func pluralOperandsOf(n interface{}) (pluralOperands, error) {
+	f, err := toFloat(n)
+	if err != nil {
+		return pluralOperands{}, err
+	}
+
+	// A string keeps its trailing zeros, "1.0" isn't singular in every language
+	s, ok := n.(string)
+	if !ok {
+		s = strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	v := 0
+	if dot := strings.IndexByte(s, '.'); dot >= 0 {
+		v = len(strings.TrimSpace(s[dot+1:]))
+	}
+
+	f = math.Abs(f)
+	return pluralOperands{n: f, i: int64(f), v: v}, nil
+}
+
+// pluralCategory returns the CLDR plural category of a number in lang: zero, one, two, few, many or other.
+// Languages without specific rules use the English ones.
+func pluralCategory(lang string, ops pluralOperands) string {
+	i, v := ops.i, ops.v
+
+	if strings.EqualFold(lang, "pt-PT") {
+		if i == 1 && v == 0 {
+			return "one"
+		}
+		return "other"
+	}
+
+	switch baseLanguage(lang) {
+	case "ja", "zh", "ko", "vi", "th", "id", "ms", "lo", "my", "km":
+		return "other"
+	case "fr", "pt":
+		if i == 0 || i == 1 {
+			return "one"
+		}
+		return "other"
+	case "ru", "uk", "be":
+		switch {
+		case v != 0:
+			return "other"
+		case i%10 == 1 && i%100 != 11:
+			return "one"
+		case i%10 >= 2 && i%10 <= 4 && (i%100 < 12 || i%100 > 14):
+			return "few"
+		}
+		return "many"
+	case "pl":
+		switch {
+		case v != 0:
+			return "other"
+		case i == 1:
+			return "one"
+		case i%10 >= 2 && i%10 <= 4 && (i%100 < 12 || i%100 > 14):
+			return "few"
+		}
+		return "many"
+	case "cs", "sk":
+		switch {
+		case v != 0:
+			return "many"
+		case i == 1:
+			return "one"
+		case i >= 2 && i <= 4:
+			return "few"
+		}
+		return "other"
+	case "ar":
+		if v != 0 {
+			return "other"
+		}
+		switch {
+		case i == 0:
+			return "zero"
+		case i == 1:
+			return "one"
+		case i == 2:
+			return "two"
+		case i%100 >= 3 && i%100 <= 10:
+			return "few"
+		case i%100 >= 11:
+			return "many"
+		}
+		return "other"
+	case "he":
+		switch {
+		case i == 1 && v == 0:
+			return "one"
+		case i == 2 && v == 0:
+			return "two"
+		}
+		return "other"
+	}
+
+	if i == 1 && v == 0 {
+		return "one"
+	}
+	return "other"
+}
+
+// plural picks the form of n matching its plural category, falling back to the other form.
+// forms is either a map of the categories, such as a vars object, or category and form pairs.
+// # is replaced by the formatted number in the chosen form.
+func plural(lang string, n interface{}, forms ...interface{}) (string, error) {
+	ops, err := pluralOperandsOf(n)
+	if err != nil {
+		return "", err
+	}
+
+	byCategory := map[string]interface{}{}
+	if len(forms) == 1 {
+		m, ok := forms[0].(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("plural forms must be an object or category and form pairs, got %T", forms[0])
+		}
+		byCategory = m
+	} else {
+		if len(forms)%2 != 0 {
+			return "", errors.New("plural forms must be category and form pairs")
+		}
+		for k := 0; k < len(forms); k += 2 {
+			byCategory[fmt.Sprint(forms[k])] = forms[k+1]
+		}
+	}
+
+	form, ok := byCategory[pluralCategory(lang, ops)]
+	if !ok {
+		form, ok = byCategory["other"]
+		if !ok {
+			return "", errors.New("plural forms need an other form")
+		}
+	}
+
+	// The visible fraction digits are kept, "1.0" isn't written as 1
+	formatted, err := formatNumber(lang, n, ops.v)
+	if err != nil {
+		return "", err
+	}
+	return strings.ReplaceAll(fmt.Sprint(form), "#", formatted), nil
+}
+
+// numberFormat holds the separators of a locale, minGrouping is the number of digits
+// needed before the first group separator, 2 when 1000 is written without one
+type numberFormat struct {
+	decimal     string
+	group       string
+	minGrouping int
+}
+
+var numberFormats = map[string]numberFormat{
+	"en":    {".", ",", 1},
+	"ja":    {".", ",", 1},
+	"zh":    {".", ",", 1},
+	"ko":    {".", ",", 1},
+	"he":    {".", ",", 1},
+	"th":    {".", ",", 1},
+	"ms":    {".", ",", 1},
+	"ar":    {".", ",", 1},
+	"de":    {",", ".", 1},
+	"de-CH": {".", "\u2019", 1},
+	"it":    {",", ".", 1},
+	"nl":    {",", ".", 1},
+	"pt":    {",", ".", 1},
+	"pt-PT": {",", "\u00a0", 2},
+	"es":    {",", ".", 2},
+	"id":    {",", ".", 1},
+	"da":    {",", ".", 1},
+	"tr":    {",", ".", 1},
+	"el":    {",", ".", 1},
+	"ro":    {",", ".", 1},
+	"hr":    {",", ".", 1},
+	"sl":    {",", ".", 1},
+	"sr":    {",", ".", 1},
+	"vi":    {",", ".", 1},
+	"fr":    {",", "\u202f", 1},
+	"fr-CH": {",", "\u202f", 1},
+	"ru":    {",", "\u00a0", 1},
+	"uk":    {",", "\u00a0", 1},
+	"be":    {",", "\u00a0", 1},
+	"pl":    {",", "\u00a0", 2},
+	"cs":    {",", "\u00a0", 1},
+	"sk":    {",", "\u00a0", 1},
+	"sv":    {",", "\u00a0", 1},
+	"fi":    {",", "\u00a0", 1},
+	"nb":    {",", "\u00a0", 1},
+	"no":    {",", "\u00a0", 1},
+	"bg":    {",", "\u00a0", 1},
+	"hu":    {",", "\u00a0", 1},
+	"lt":    {",", "\u00a0", 1},
+	"lv":    {",", "\u00a0", 1},
+	"et":    {",", "\u00a0", 1},
+}
+
+// formatNumber writes n with the separators of lang, with the given number of decimals or as many as needed
+func formatNumber(lang string, n interface{}, decimals ...int) (string, error) {
+	f, err := toFloat(n)
+	if err != nil {
+		return "", err
+	}
+
+	nf, ok := numberFormats[lang]
+	if !ok {
+		nf, ok = numberFormats[baseLanguage(lang)]
+		if !ok {
+			nf = numberFormats["en"]
+		}
+	}
+
+	precision := -1
+	if len(decimals) > 0 {
+		precision = decimals[0]
+	}
+	s := strconv.FormatFloat(math.Abs(f), 'f', precision, 64)
+
+	intPart, fracPart := s, ""
+	if dot := strings.IndexByte(s, '.'); dot >= 0 {
+		intPart, fracPart = s[:dot], s[dot+1:]
+	}
+
+	if len(intPart) > 3+nf.minGrouping-1 {
+		grouped := intPart[:len(intPart)%3]
+		for k := len(intPart) % 3; k < len(intPart); k += 3 {
+			if grouped != "" {
+				grouped += nf.group
+			}
+			grouped += intPart[k : k+3]
+		}
+		intPart = grouped
+	}
+
+	out := intPart
+	if fracPart != "" {
+		out += nf.decimal + fracPart
+	}
+	if f < 0 && strings.Trim(s, "0.") != "" {
+		out = "-" + out
+	}
+	return out, nil
+}
+
+// dateLocale holds the names and the CLDR date patterns of a language
+type dateLocale struct {
+	months      [12]string
+	shortMonths [12]string
+	weekdays    [7]string // From Sunday
+	styles      map[string]string
+}
+
+var dateLocales = map[string]dateLocale{
+	"en": {
+		months:      [12]string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"},
+		shortMonths: [12]string{"Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec"},
+		weekdays:    [7]string{"Sunday", "Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday"},
+		styles:      map[string]string{"short": "M/d/yy", "medium": "MMM d, y", "long": "MMMM d, y", "full": "EEEE, MMMM d, y"},
+	},
+	"fr": {
+		months:      [12]string{"janvier", "février", "mars", "avril", "mai", "juin", "juillet", "août", "septembre", "octobre", "novembre", "décembre"},
+		shortMonths: [12]string{"janv.", "févr.", "mars", "avr.", "mai", "juin", "juil.", "août", "sept.", "oct.", "nov.", "déc."},
+		weekdays:    [7]string{"dimanche", "lundi", "mardi", "mercredi", "jeudi", "vendredi", "samedi"},
+		styles:      map[string]string{"short": "dd/MM/y", "medium": "d MMM y", "long": "d MMMM y", "full": "EEEE d MMMM y"},
+	},
+	"de": {
+		months:      [12]string{"Januar", "Februar", "März", "April", "Mai", "Juni", "Juli", "August", "September", "Oktober", "November", "Dezember"},
+		shortMonths: [12]string{"Jan.", "Feb.", "März", "Apr.", "Mai", "Juni", "Juli", "Aug.", "Sept.", "Okt.", "Nov.", "Dez."},
+		weekdays:    [7]string{"Sonntag", "Montag", "Dienstag", "Mittwoch", "Donnerstag", "Freitag", "Samstag"},
+		styles:      map[string]string{"short": "dd.MM.yy", "medium": "dd.MM.y", "long": "d. MMMM y", "full": "EEEE, d. MMMM y"},
+	},
+	"es": {
+		months:      [12]string{"enero", "febrero", "marzo", "abril", "mayo", "junio", "julio", "agosto", "septiembre", "octubre", "noviembre", "diciembre"},
+		shortMonths: [12]string{"ene", "feb", "mar", "abr", "may", "jun", "jul", "ago", "sept", "oct", "nov", "dic"},
+		weekdays:    [7]string{"domingo", "lunes", "martes", "miércoles", "jueves", "viernes", "sábado"},
+		styles:      map[string]string{"short": "d/M/yy", "medium": "d MMM y", "long": "d 'de' MMMM 'de' y", "full": "EEEE, d 'de' MMMM 'de' y"},
+	},
+	"it": {
+		months:      [12]string{"gennaio", "febbraio", "marzo", "aprile", "maggio", "giugno", "luglio", "agosto", "settembre", "ottobre", "novembre", "dicembre"},
+		shortMonths: [12]string{"gen", "feb", "mar", "apr", "mag", "giu", "lug", "ago", "set", "ott", "nov", "dic"},
+		weekdays:    [7]string{"domenica", "lunedì", "martedì", "mercoledì", "giovedì", "venerdì", "sabato"},
+		styles:      map[string]string{"short": "dd/MM/yy", "medium": "d MMM y", "long": "d MMMM y", "full": "EEEE d MMMM y"},
+	},
+	"pt": {
+		months:      [12]string{"janeiro", "fevereiro", "março", "abril", "maio", "junho", "julho", "agosto", "setembro", "outubro", "novembro", "dezembro"},
+		shortMonths: [12]string{"jan.", "fev.", "mar.", "abr.", "mai.", "jun.", "jul.", "ago.", "set.", "out.", "nov.", "dez."},
+		weekdays:    [7]string{"domingo", "segunda-feira", "terça-feira", "quarta-feira", "quinta-feira", "sexta-feira", "sábado"},
+		styles:      map[string]string{"short": "dd/MM/y", "medium": "d 'de' MMM 'de' y", "long": "d 'de' MMMM 'de' y", "full": "EEEE, d 'de' MMMM 'de' y"},
+	},
+	"nl": {
+		months:      [12]string{"januari", "februari", "maart", "april", "mei", "juni", "juli", "augustus", "september", "oktober", "november", "december"},
+		shortMonths: [12]string{"jan", "feb", "mrt", "apr", "mei", "jun", "jul", "aug", "sep", "okt", "nov", "dec"},
+		weekdays:    [7]string{"zondag", "maandag", "dinsdag", "woensdag", "donderdag", "vrijdag", "zaterdag"},
+		styles:      map[string]string{"short": "dd-MM-y", "medium": "d MMM y", "long": "d MMMM y", "full": "EEEE d MMMM y"},
+	},
+}
+
+var dateInputLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"}
+
+// formatDate writes a date in lang. style is short, medium (the default), long, full or a CLDR pattern such as "d MMMM y".
+// The date is a time.Time, an ISO 8601 string or a Unix timestamp.
+func formatDate(lang string, date interface{}, style ...string) (string, error) {
+	var t time.Time
+	switch v := date.(type) {
+	case time.Time:
+		t = v
+	case string:
+		parsed := false
+		for _, layout := range dateInputLayouts {
+			if p, err := time.Parse(layout, v); err == nil {
+				t, parsed = p, true
+				break
+			}
+		}
+		if !parsed {
+			return "", fmt.Errorf("%q is not an ISO 8601 date", v)
+		}
+	default:
+		f, err := toFloat(v)
+		if err != nil {
+			return "", fmt.Errorf("%v is not a date", date)
+		}
+		t = time.Unix(int64(f), 0).UTC()
+	}
+
+	loc, ok := dateLocales[baseLanguage(lang)]
+	if !ok {
+		loc = dateLocales["en"]
+	}
+
+	pattern := loc.styles["medium"]
+	if len(style) > 0 {
+		pattern = style[0]
+		if p, ok := loc.styles[pattern]; ok {
+			pattern = p
+		}
+	}
+
+	return formatDatePattern(t, pattern, loc), nil
+}
+
+// formatDatePattern supports the y, M, d, E, H, h, m, s and a CLDR fields, text between single quotes is kept as is
+// and two single quotes write one
+func formatDatePattern(t time.Time, pattern string, loc dateLocale) string {
+	out := strings.Builder{}
+	pad := func(v, width int) {
+		s := strconv.Itoa(v)
+		for k := len(s); k < width; k++ {
+			out.WriteByte('0')
+		}
+		out.WriteString(s)
+	}
+
+	for k := 0; k < len(pattern); {
+		c := pattern[k]
+
+		if c == '\'' {
+			if k+1 < len(pattern) && pattern[k+1] == '\'' {
+				out.WriteByte('\'')
+				k += 2
+				continue
+			}
+			// Two single quotes in quoted text are a quote too
+			for k++; k < len(pattern); k++ {
+				if pattern[k] != '\'' {
+					out.WriteByte(pattern[k])
+				} else if k+1 < len(pattern) && pattern[k+1] == '\'' {
+					out.WriteByte('\'')
+					k++
+				} else {
+					k++
+					break
+				}
+			}
+			continue
+		}
+
+		width := 1
+		for k+width < len(pattern) && pattern[k+width] == c {
+			width++
+		}
+
+		switch c {
+		case 'y':
+			if width == 2 {
+				pad(t.Year()%100, 2)
+			} else {
+				pad(t.Year(), width)
+			}
+		case 'M':
+			switch {
+			case width >= 4:
+				out.WriteString(loc.months[t.Month()-1])
+			case width == 3:
+				out.WriteString(loc.shortMonths[t.Month()-1])
+			default:
+				pad(int(t.Month()), width)
+			}
+		case 'd':
+			pad(t.Day(), width)
+		case 'E':
+			name := loc.weekdays[t.Weekday()]
+			if width < 4 {
+				r := []rune(name)
+				if len(r) > 3 {
+					name = string(r[:3])
+				}
+			}
+			out.WriteString(name)
+		case 'H':
+			pad(t.Hour(), width)
+		case 'h':
+			h := t.Hour() % 12
+			if h == 0 {
+				h = 12
+			}
+			pad(h, width)
+		case 'm':
+			pad(t.Minute(), width)
+		case 's':
+			pad(t.Second(), width)
+		case 'a':
+			if t.Hour() < 12 {
+				out.WriteString("AM")
+			} else {
+				out.WriteString("PM")
+			}
+		default:
+			out.WriteString(pattern[k : k+width])
+		}
+		k += width
+	}
+
+	return out.String()
+}
+
+// translate returns the var at the dotted key, with the {name} placeholders replaced by the name and value pairs of args.
+// A missing key renders as the key itself.
+func translate(data map[string]interface{}, key string, args ...interface{}) (string, error) {
+	if len(args)%2 != 0 {
+		return "", errors.New("t arguments must be name and value pairs")
+	}
+
+	var v interface{} = data
+	for _, k := range strings.Split(key, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			v = nil
+			break
+		}
+		v = m[k]
+	}
+	if v == nil {
+		tlogger.Debug("builder", "funcs", "msg", "Missing translation", "key", key)
+		return key, nil
+	}
+
+	s := fmt.Sprint(v)
+	for k := 0; k < len(args); k += 2 {
+		s = strings.ReplaceAll(s, "{"+fmt.Sprint(args[k])+"}", fmt.Sprint(args[k+1]))
+	}
+	return s, nil
+}
+
+// titleCase upper cases the first letter of every word
+func titleCase(s string) string {
+	out := []rune(s)
+	for k := range out {
+		if k == 0 || unicode.IsSpace(out[k-1]) || out[k-1] == '-' {
+			out[k] = unicode.ToUpper(out[k])
+		}
+	}
+	return string(out)
+}
+
+// truncate cuts s to n characters, ending it with an ellipsis when it was longer
+func truncate(n int, s string) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	if n <= 0 {
+		return ""
+	}
+	return strings.TrimRightFunc(string([]rune(s)[:n-1]), unicode.IsSpace) + "…"
+}
+
+func join(sep string, list interface{}) (string, error) {
+	switch l := list.(type) {
+	case []string:
+		return strings.Join(l, sep), nil
+	case []interface{}:
+		parts := make([]string, len(l))
+		for k, v := range l {
+			parts[k] = fmt.Sprint(v)
+		}
+		return strings.Join(parts, sep), nil
+	}
+	return "", fmt.Errorf("can't join %T", list)
+}
+
+// toJSON renders v as JSON, it can be used as is in a script
+func toJSON(v interface{}) (htemplate.JS, error) {
+	out, err := json.Marshal(v)
+	return htemplate.JS(out), err
+}
+
+// defaultValue returns value, or fallback when value is empty
+func defaultValue(fallback, value interface{}) interface{} {
+	if truth, ok := ttemplate.IsTrue(value); !ok || !truth {
+		return fallback
+	}
+	return value
+}
+
+// baseLanguage returns the language subtag of a language code, fr for fr-CA
+func baseLanguage(lang string) string {
+	if k := strings.IndexAny(lang, "-_"); k >= 0 {
+		lang = lang[:k]
+	}
+	return strings.ToLower(lang)
+}
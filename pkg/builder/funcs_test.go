@@ -0,0 +1,238 @@
+package builder
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestPluralCategory(t *testing.T) {
+	tests := []struct {
+		lang string
+		n    interface{}
+		want string
+	}{
+		{"en", 1, "one"},
+		{"en", 0, "other"},
+		{"en", "1.0", "other"},
+		{"fr", 0, "one"},
+		{"fr", 1.5, "one"},
+		{"fr", 2, "other"},
+		{"pt-PT", 0, "other"},
+		{"ru", 1, "one"},
+		{"ru", 21, "one"},
+		{"ru", 11, "many"},
+		{"ru", 2, "few"},
+		{"ru", 24, "few"},
+		{"ru", 12, "many"},
+		{"ru", 5, "many"},
+		{"ru", 111, "many"},
+		{"ru", 1.5, "other"},
+		{"ru", "1.0", "other"},
+		{"pl", 1, "one"},
+		{"pl", 21, "many"},
+		{"pl", 22, "few"},
+		{"pl", 14, "many"},
+		{"pl", 0, "many"},
+		{"pl", 2.5, "other"},
+		{"cs", 1, "one"},
+		{"cs", 3, "few"},
+		{"cs", 5, "other"},
+		{"cs", 0, "other"},
+		{"cs", 1.5, "many"},
+		{"ar", 0, "zero"},
+		{"ar", 1, "one"},
+		{"ar", 2, "two"},
+		{"ar", 3, "few"},
+		{"ar", 103, "few"},
+		{"ar", 11, "many"},
+		{"ar", 99, "many"},
+		{"ar", 100, "other"},
+		{"ar", 102, "other"},
+		{"ar", 0.5, "other"},
+		{"ja", 1, "other"},
+	}
+
+	for _, tt := range tests {
+		ops, err := pluralOperandsOf(tt.n)
+		if err != nil {
+			t.Errorf("pluralOperandsOf(%v): %v", tt.n, err)
+			continue
+		}
+		if got := pluralCategory(tt.lang, ops); got != tt.want {
+			t.Errorf("pluralCategory(%s, %v) = %s, want %s", tt.lang, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestPlural(t *testing.T) {
+	tests := []struct {
+		lang  string
+		n     interface{}
+		forms []interface{}
+		want  string
+	}{
+		{"en", 1, []interface{}{"one", "# item", "other", "# items"}, "1 item"},
+		{"en", 1000, []interface{}{"one", "# item", "other", "# items"}, "1,000 items"},
+		{"en", "1.0", []interface{}{"one", "# item", "other", "# items"}, "1.0 items"},
+		{"en", "2.50", []interface{}{"one", "# item", "other", "# items"}, "2.50 items"},
+		{"fr", 1.5, []interface{}{"one", "# élément", "other", "# éléments"}, "1,5 élément"},
+		{"ru", 3, []interface{}{map[string]interface{}{"one": "# файл", "few": "# файла", "other": "# файлов"}}, "3 файла"},
+		{"ru", 5, []interface{}{map[string]interface{}{"one": "# файл", "few": "# файла", "other": "# файлов"}}, "5 файлов"},
+	}
+
+	for _, tt := range tests {
+		got, err := plural(tt.lang, tt.n, tt.forms...)
+		if err != nil {
+			t.Errorf("plural(%s, %v): %v", tt.lang, tt.n, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("plural(%s, %v) = %q, want %q", tt.lang, tt.n, got, tt.want)
+		}
+	}
+
+	if _, err := plural("en", 2, "one", "# item"); err == nil {
+		t.Error("plural without an other form should fail")
+	}
+	if _, err := plural("en", 2, "one"); err == nil {
+		t.Error("plural with an odd number of forms should fail")
+	}
+}
+
+func TestFormatNumber(t *testing.T) {
+	tests := []struct {
+		lang     string
+		n        interface{}
+		decimals []int
+		want     string
+	}{
+		{"en", 1234.5, nil, "1,234.5"},
+		{"en", 999, nil, "999"},
+		{"en", 1234567, nil, "1,234,567"},
+		{"en-GB", 1234, nil, "1,234"},
+		{"xx", 1234, nil, "1,234"},
+		{"de", 1234.5, []int{2}, "1.234,50"},
+		{"fr", 1234567, nil, "1 234 567"},
+		{"es", 1234, nil, "1234"},
+		{"es", 12345, nil, "12.345"},
+		{"pl", 1234, nil, "1234"},
+		{"pl", 12345, nil, "12 345"},
+		{"pt-PT", 1234, nil, "1234"},
+		{"pt-BR", 1234, nil, "1.234"},
+		{"en", -1234, nil, "-1,234"},
+		{"en", math.Copysign(0, -1), nil, "0"},
+		{"en", -0.001, []int{2}, "0.00"},
+		{"en", -0.5, []int{0}, "0"},
+		{"en", -0.5, nil, "-0.5"},
+		{"en", "42", nil, "42"},
+	}
+
+	for _, tt := range tests {
+		got, err := formatNumber(tt.lang, tt.n, tt.decimals...)
+		if err != nil {
+			t.Errorf("formatNumber(%s, %v): %v", tt.lang, tt.n, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("formatNumber(%s, %v, %v) = %q, want %q", tt.lang, tt.n, tt.decimals, got, tt.want)
+		}
+	}
+
+	if _, err := formatNumber("en", "abc"); !errors.Is(err, ErrNotANumber) {
+		t.Errorf("formatNumber(en, abc) error = %v, want ErrNotANumber", err)
+	}
+}
+
+func TestFormatDatePattern(t *testing.T) {
+	date := time.Date(2024, time.March, 5, 14, 7, 9, 0, time.UTC)
+
+	tests := []struct {
+		lang    string
+		pattern string
+		want    string
+	}{
+		{"en", "yy-MM-dd HH:mm:ss", "24-03-05 14:07:09"},
+		{"en", "EEEE, MMMM d, y", "Tuesday, March 5, 2024"},
+		{"en", "E d MMM", "Tue 5 Mar"},
+		{"en", "hh:mm a", "02:07 PM"},
+		{"fr", "EEEE d MMMM y", "mardi 5 mars 2024"},
+		{"es", "d 'de' MMMM 'de' y", "5 de marzo de 2024"},
+		{"en", "h 'o''clock' a", "2 o'clock PM"},
+		{"en", "''yy", "'24"},
+		{"en", "'d' d", "d 5"},
+		{"en", "'at' H 'h", "at 14 h"},
+	}
+
+	for _, tt := range tests {
+		if got := formatDatePattern(date, tt.pattern, dateLocales[tt.lang]); got != tt.want {
+			t.Errorf("formatDatePattern(%s, %q) = %q, want %q", tt.lang, tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	data := map[string]interface{}{
+		"title": "Home",
+		"count": float64(3),
+		"nav": map[string]interface{}{
+			"greeting": "Hello {name}, {name}!",
+			"welcome":  "Welcome {first} {last}",
+		},
+	}
+
+	tests := []struct {
+		key  string
+		args []interface{}
+		want string
+	}{
+		{"title", nil, "Home"},
+		{"count", nil, "3"},
+		{"nav.greeting", []interface{}{"name", "Ana"}, "Hello Ana, Ana!"},
+		{"nav.welcome", []interface{}{"first", "Ana", "last", 2}, "Welcome Ana 2"},
+		{"nav.welcome", nil, "Welcome {first} {last}"},
+		{"nav.missing", nil, "nav.missing"},
+		{"title.sub", nil, "title.sub"},
+		{"missing", nil, "missing"},
+	}
+
+	for _, tt := range tests {
+		got, err := translate(data, tt.key, tt.args...)
+		if err != nil {
+			t.Errorf("translate(%s): %v", tt.key, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("translate(%s, %v) = %q, want %q", tt.key, tt.args, got, tt.want)
+		}
+	}
+
+	if _, err := translate(data, "nav.greeting", "name"); err == nil {
+		t.Error("translate with an odd number of arguments should fail")
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		n    int
+		s    string
+		want string
+	}{
+		{5, "hello", "hello"},
+		{10, "hello", "hello"},
+		{4, "hello", "hel…"},
+		{3, "héllo", "hé…"},
+		{4, "ab cd", "ab…"},
+		{1, "hello", "…"},
+		{0, "hello", ""},
+		{-1, "hello", ""},
+		{3, "", ""},
+	}
+
+	for _, tt := range tests {
+		if got := truncate(tt.n, tt.s); got != tt.want {
+			t.Errorf("truncate(%d, %q) = %q, want %q", tt.n, tt.s, got, tt.want)
+		}
+	}
+}
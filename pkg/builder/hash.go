@@ -0,0 +1,251 @@
+package builder
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/toastate/toastfront/internal/helpers"
+	"github.com/toastate/toastfront/internal/tlogger"
+)
+
+// AssetManifestFile is written at the root of every build directory when assets are hashed
+const AssetManifestFile = "asset-manifest.json"
+
+const assetHashLength = 8
+
+var HTMLAssetRefRegexp = regexp.MustCompile(`(?i)\b(src|href)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'=<>` + "`" + `]+))`)
+var CSSAssetRefRegexp = regexp.MustCompile(`url\(\s*(['"]?)([^'")]+)(['"]?)\s*\)`)
+
+type outputKind int
+
+const (
+	outputCopy outputKind = iota
+	outputCopyCSS
+	outputCSS
+	outputJS
+	outputHTML
+)
+
+// registerOutput records a generated file (relative to the build directory) for the post build steps
+func (b *Builder) registerOutput(path string, kind outputKind) {
+	if b.opts == nil || !b.opts.HashAssets {
+		return
+	}
+	b.outputsMu.Lock()
+	defer b.outputsMu.Unlock()
+
+	if b.outputs == nil {
+		b.outputs = map[string]outputKind{}
+	}
+	if kind == outputCopy && filepath.Ext(path) == ".css" {
+		kind = outputCopyCSS
+	}
+	b.outputs[filepath.ToSlash(path)] = kind
+}
+
+func (b *Builder) outputsOfKind(kind outputKind) []string {
+	out := []string{}
+	for p, k := range b.outputs {
+		if k == kind {
+			out = append(out, p)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// hashAssets renames the JS, CSS and copied files to content hashed names,
+// rewrites the references found in the generated HTML and CSS and writes the asset manifests.
+// Absolute references are resolved against the root builder output, relative ones against the file's own build directory.
+func (b *Builder) hashAssets() error {
+	builders := []*Builder{b}
+	for _, lg := range b.subBuilderLanguages() {
+		builders = append(builders, b.subBuilders[lg])
+	}
+
+	for _, bd := range builders {
+		bd.assetManifest = map[string]string{}
+	}
+
+	// Copied stylesheets (vendors) are hashed after the other copied files so their url() can be rewritten
+	for _, kind := range []outputKind{outputCopy, outputCopyCSS, outputCSS, outputJS} {
+		for _, bd := range builders {
+			for _, p := range bd.outputsOfKind(kind) {
+				// Top level files (favicon.ico, manifest.json, robots.txt...) are fetched by their well known names
+				if kind != outputCSS && kind != outputJS && path.Dir(p) == "." {
+					continue
+				}
+
+				err := bd.hashAsset(b, p, kind)
+				if err != nil {
+					tlogger.Error("msg", "Failed to hash asset", "path", p, "err", err)
+					return err
+				}
+			}
+		}
+	}
+
+	for _, bd := range builders {
+		for _, p := range bd.outputsOfKind(outputHTML) {
+			content, err := bd.readOutput(p)
+			if err != nil {
+				return err
+			}
+
+			content = bd.rewriteHTMLRefs(b, p, content)
+
+			err = bd.writeOutput(p, content)
+			if err != nil {
+				tlogger.Error("msg", "Failed to rewrite asset references", "path", p, "err", err)
+				return err
+			}
+		}
+
+		manifest, err := helpers.MarshalJson(bd.assetManifest)
+		if err != nil {
+			return err
+		}
+		err = bd.writeOutput(AssetManifestFile, manifest)
+		if err != nil {
+			tlogger.Error("msg", "Failed to write asset manifest", "path", bd.buildDir, "err", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *Builder) hashAsset(root *Builder, p string, kind outputKind) error {
+	content, err := b.readOutput(p)
+	if err != nil {
+		return err
+	}
+
+	if kind == outputCSS || kind == outputCopyCSS {
+		content = b.rewriteCSSRefs(root, p, content)
+	}
+
+	hashedPath := hashedName(p, content)
+
+	if _, err := b.readOutput(p + ".map"); err == nil {
+		content = bytes.Replace(content, []byte("sourceMappingURL="+path.Base(p)+".map"), []byte("sourceMappingURL="+path.Base(hashedPath)+".map"), 1)
+
+		err = b.renameSourceMap(p, hashedPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = b.writeOutput(hashedPath, content)
+	if err != nil {
+		return err
+	}
+	err = b.removeOutput(p)
+	if err != nil {
+		return err
+	}
+
+	b.assetManifest[p] = hashedPath
+	tlogger.Debug("msg", "Asset hashed", "path", p, "hashed", hashedPath)
+	return nil
+}
+
+func (b *Builder) renameSourceMap(p, hashedPath string) error {
+	mapPath := p + ".map"
+	content, err := b.readOutput(mapPath)
+	if err != nil {
+		return err
+	}
+
+	sm := &sourceMap{}
+	err = json.Unmarshal(content, sm)
+	if err != nil {
+		return err
+	}
+	sm.File = path.Base(hashedPath)
+
+	content, err = helpers.MarshalJson(sm)
+	if err != nil {
+		return err
+	}
+	err = b.writeOutput(hashedPath+".map", content)
+	if err != nil {
+		return err
+	}
+	return b.removeOutput(mapPath)
+}
+
+// hashedName inserts the content hash before the extension: js/main.js -> js/main.3f9a1c2b.js
+func hashedName(p string, content []byte) string {
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])[:assetHashLength]
+
+	ext := path.Ext(p)
+	return p[:len(p)-len(ext)] + "." + hash + ext
+}
+
+func (b *Builder) rewriteHTMLRefs(root *Builder, from string, content []byte) []byte {
+	return HTMLAssetRefRegexp.ReplaceAllFunc(content, func(match []byte) []byte {
+		sub := HTMLAssetRefRegexp.FindSubmatch(match)
+
+		quote := ""
+		ref := sub[4]
+		switch {
+		case sub[2] != nil:
+			quote, ref = `"`, sub[2]
+		case sub[3] != nil:
+			quote, ref = `'`, sub[3]
+		}
+
+		hashed, ok := b.resolveHashedRef(root, from, string(ref))
+		if !ok {
+			return match
+		}
+		return []byte(string(sub[1]) + "=" + quote + hashed + quote)
+	})
+}
+
+func (b *Builder) rewriteCSSRefs(root *Builder, from string, content []byte) []byte {
+	return CSSAssetRefRegexp.ReplaceAllFunc(content, func(match []byte) []byte {
+		sub := CSSAssetRefRegexp.FindSubmatch(match)
+
+		hashed, ok := b.resolveHashedRef(root, from, string(sub[2]))
+		if !ok {
+			return match
+		}
+		return []byte("url(" + string(sub[1]) + hashed + string(sub[3]) + ")")
+	})
+}
+
+// resolveHashedRef returns the hashed version of ref, as found in the file at from, if it targets a hashed asset
+func (b *Builder) resolveHashedRef(root *Builder, from string, ref string) (string, bool) {
+	suffix := ""
+	if i := strings.IndexAny(ref, "?#"); i >= 0 {
+		ref, suffix = ref[:i], ref[i:]
+	}
+
+	if ref == "" || strings.HasPrefix(ref, "//") || strings.Contains(ref, ":") {
+		return "", false
+	}
+
+	if strings.HasPrefix(ref, "/") {
+		hashed, ok := root.assetManifest[path.Clean(ref[1:])]
+		if !ok {
+			return "", false
+		}
+		return "/" + hashed + suffix, true
+	}
+
+	hashed, ok := b.assetManifest[path.Join(path.Dir(from), ref)]
+	if !ok {
+		return "", false
+	}
+	return path.Join(path.Dir(ref), path.Base(hashed)) + suffix, true
+}
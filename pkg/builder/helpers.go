@@ -3,7 +3,6 @@ package builder
 import (
 	"fmt"
 	"io"
-	"os"
 	"regexp"
 )
 
@@ -13,8 +12,15 @@ func replaceWindowsCarriageReturn(b []byte) []byte {
 	return windowCRregexp.ReplaceAll(b, []byte("\n"))
 }
 
-func copyFile(src, dst string) (int64, error) {
-	sourceFileStat, err := os.Stat(src)
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// copyFile copies the source file src to dst in the output
+func (b *Builder) copyFile(src, dst string) (int64, error) {
+	sourceFileStat, err := b.statSource(src)
 	if err != nil {
 		return 0, err
 	}
@@ -23,13 +29,13 @@ func copyFile(src, dst string) (int64, error) {
 		return 0, fmt.Errorf("%s is not a regular file", src)
 	}
 
-	source, err := os.Open(src)
+	source, err := b.openSource(src)
 	if err != nil {
 		return 0, err
 	}
 	defer source.Close()
 
-	destination, err := os.Create(dst)
+	destination, err := b.createOutput(dst)
 	if err != nil {
 		return 0, err
 	}
@@ -0,0 +1,524 @@
+package builder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	ttemplate "text/template"
+	"text/template/parse"
+
+	"github.com/toastate/toastfront/internal/tlogger"
+	"github.com/toastate/toastfront/pkg/config"
+)
+
+var ErrTranslations = errors.New("translation check failed")
+
+// TranslationIssue is a problem found by CheckTranslations
+type TranslationIssue struct {
+	File     string // Relative to the source directory
+	Line     int    // 0 when the issue isn't about a specific line
+	Language string
+	Message  string
+	Warning  bool
+}
+
+func (i TranslationIssue) String() string {
+	loc := i.File
+	if i.Line > 0 {
+		loc += ":" + strconv.Itoa(i.Line)
+	}
+	if i.Language != "" {
+		loc += " [" + i.Language + "]"
+	}
+	return loc + ": " + i.Message
+}
+
+// CheckTranslations compares the keys of the lang-<code>.json vars files of every vars folder,
+// and looks for references to undefined vars in the pages of every language.
+// A key missing from a language while others define it is an error even when it falls back to another language,
+// a key defined by a single language is also a warning in the file of that language.
+func (b *Builder) CheckTranslations() ([]TranslationIssue, error) {
+	err := b.Init()
+	if err != nil {
+		return nil, err
+	}
+
+	issues, err := b.checkVarsKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	builders := []*Builder{b}
+	for _, lg := range b.subBuilderLanguages() {
+		builders = append(builders, b.subBuilders[lg])
+	}
+	for _, bd := range builders {
+		langIssues, err := bd.checkVarsReferences()
+		if err != nil {
+			return nil, err
+		}
+		issues = append(issues, langIssues...)
+	}
+
+	// Layouts and imports are shared by many pages, report their issues once
+	seen := map[TranslationIssue]struct{}{}
+	out := []TranslationIssue{}
+	for _, issue := range issues {
+		if _, ok := seen[issue]; ok {
+			continue
+		}
+		seen[issue] = struct{}{}
+		out = append(out, issue)
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].File != out[j].File {
+			return out[i].File < out[j].File
+		}
+		return out[i].Line < out[j].Line
+	})
+
+	return out, nil
+}
+
+// checkStrictTranslations logs the translation issues and fails when some are errors
+func (b *Builder) checkStrictTranslations() error {
+	issues, err := b.CheckTranslations()
+	if err != nil {
+		return err
+	}
+
+	failed := false
+	for _, issue := range issues {
+		message := issue.Message
+		if issue.Language != "" {
+			message = "[" + issue.Language + "] " + message
+		}
+		if issue.Warning {
+			tlogger.Warn("builder", "i18n", "msg", issue.Message, "file", issue.File, "line", issue.Line, "lang", issue.Language)
+			b.diagnostics.warn("i18n", issue.File, issue.Line, message)
+		} else {
+			tlogger.Error("builder", "i18n", "msg", issue.Message, "file", issue.File, "line", issue.Line, "lang", issue.Language)
+			b.diagnostics.error(&BuildError{Builder: "i18n", File: issue.File, Line: issue.Line, Message: message})
+			failed = true
+		}
+	}
+	if failed {
+		return ErrTranslations
+	}
+	return nil
+}
+
+// checkVarsKeys compares the lang-<code>.json files of every folder of the vars directory,
+// a key defined by any language of a folder must be defined by all of them
+// and keys only one language defines are reported as extra
+func (b *Builder) checkVarsKeys() ([]TranslationIssue, error) {
+	varsFolder := b.fileBuilders["html"].(*HTMLBuilder).varsFolder
+	issues := []TranslationIssue{}
+
+	err := b.walkSource(varsFolder, func(dir string, info fs.FileInfo, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+
+		langFiles, err := fs.Glob(b.src, path.Join(sourceName(dir), "lang-*.json"))
+		if err != nil || len(langFiles) == 0 {
+			return err
+		}
+
+		// Keys of every language of the folder, a missing file has no keys
+		keys := map[string]map[string]struct{}{}
+		for _, lg := range config.Config.Languages {
+			keys[lg] = map[string]struct{}{}
+		}
+		for _, f := range langFiles {
+			lg := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(f), "lang-"), ".json")
+			if _, ok := keys[lg]; !ok {
+				issues = append(issues, TranslationIssue{File: filepath.Join(dir, filepath.Base(f)), Message: fmt.Sprintf("%s isn't a configured language", lg), Warning: true})
+				continue
+			}
+
+			fileKeys, err := b.readVarsKeys(filepath.FromSlash(f))
+			if err != nil {
+				issues = append(issues, TranslationIssue{File: filepath.Join(dir, filepath.Base(f)), Language: lg, Message: err.Error()})
+				continue
+			}
+			keys[lg] = fileKeys
+		}
+
+		// Every language is compared to the keys of all the languages of the folder
+		all := map[string]struct{}{}
+		for _, lgKeys := range keys {
+			for k := range lgKeys {
+				all[k] = struct{}{}
+			}
+		}
+
+		// Keys falling back to common.json aren't missing
+		common, _ := b.readVarsKeys(filepath.Join(dir, "common.json"))
+
+		for _, lg := range config.Config.Languages {
+			file := filepath.Join(dir, "lang-"+lg+".json")
+			if _, err := b.statSource(file); errors.Is(err, fs.ErrNotExist) {
+				issues = append(issues, TranslationIssue{File: file, Language: lg, Message: "missing vars file"})
+				continue
+			}
+
+			for _, k := range sortedSet(all) {
+				if _, ok := keys[lg][k]; ok || isPluralForm(k, keys[lg], all) {
+					continue
+				}
+				if _, ok := common[k]; ok {
+					continue
+				}
+				message := fmt.Sprintf("missing key %q, defined by %s", k, strings.Join(definedBy(k, keys), ", "))
+				if fallback := b.fallbackLanguage(dir, lg, k, keys); fallback != "" {
+					message += ", falls back to " + fallback
+				}
+				issues = append(issues, TranslationIssue{File: file, Language: lg, Message: message})
+			}
+
+			if len(config.Config.Languages) < 2 {
+				continue
+			}
+			others := map[string]struct{}{}
+			for otherLg, lgKeys := range keys {
+				if otherLg == lg {
+					continue
+				}
+				for k := range lgKeys {
+					others[k] = struct{}{}
+				}
+			}
+			for _, k := range sortedSet(keys[lg]) {
+				if _, ok := others[k]; ok || isPluralForm(k, keys[lg], others) {
+					continue
+				}
+				if _, ok := common[k]; ok {
+					continue
+				}
+				issues = append(issues, TranslationIssue{File: file, Language: lg, Message: fmt.Sprintf("extra key %q, no other language defines it", k), Warning: true})
+			}
+		}
+
+		return nil
+	})
+
+	return issues, err
+}
+
+// fallbackLanguage returns the language of the vars folder dir the key missing from lang is taken from, if any.
+// keys caches the keys of the language files of the folder.
+func (b *Builder) fallbackLanguage(dir, lang, key string, keys map[string]map[string]struct{}) string {
+	for _, lg := range config.Config.ResolvedFallbacks(lang) {
+		if _, ok := keys[lg]; !ok {
+			keys[lg], _ = b.readVarsKeys(filepath.Join(dir, "lang-"+lg+".json"))
+		}
+		if _, ok := keys[lg][key]; ok {
+			return lg
+		}
+	}
+	return ""
+}
+
+// definedBy returns the languages defining key, in the configuration order
+func definedBy(key string, keys map[string]map[string]struct{}) []string {
+	out := []string{}
+	for _, lg := range config.Config.Languages {
+		if _, ok := keys[lg][key]; ok {
+			out = append(out, lg)
+		}
+	}
+	return out
+}
+
+// isPluralForm reports whether key is a plural form other than other of an object whose other form
+// both key sets a and b define, the plural categories each language needs differ
+func isPluralForm(key string, a, b map[string]struct{}) bool {
+	k := strings.LastIndexByte(key, '.')
+	if k < 0 {
+		return false
+	}
+	switch key[k+1:] {
+	case "zero", "one", "two", "few", "many":
+	default:
+		return false
+	}
+
+	other := key[:k] + ".other"
+	_, okA := a[other]
+	_, okB := b[other]
+	return okA && okB
+}
+
+// readVarsKeys returns the keys of a vars file, nested keys are joined with dots
+func (b *Builder) readVarsKeys(file string) (map[string]struct{}, error) {
+	content, err := b.readSource(file)
+	if err != nil {
+		return nil, err
+	}
+
+	data := map[string]interface{}{}
+	err = json.Unmarshal(content, &data)
+	if err != nil {
+		return nil, fmt.Errorf("can't decode vars file: %v", err)
+	}
+
+	keys := map[string]struct{}{}
+	flattenKeys("", data, keys)
+	return keys, nil
+}
+
+func flattenKeys(prefix string, data map[string]interface{}, keys map[string]struct{}) {
+	for k, v := range data {
+		if sub, ok := v.(map[string]interface{}); ok && len(sub) > 0 {
+			flattenKeys(prefix+k+".", sub, keys)
+			continue
+		}
+		keys[prefix+k] = struct{}{}
+	}
+}
+
+func sortedSet(set map[string]struct{}) []string {
+	out := make([]string, 0, len(set))
+	for k := range set {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// checkVarsReferences looks for the vars used by the pages of the builder language that its vars don't define
+func (b *Builder) checkVarsReferences() ([]TranslationIssue, error) {
+	hb := b.fileBuilders["html"].(*HTMLBuilder)
+	mb := b.fileBuilders["markdown"].(*MarkdownBuilder)
+	issues := []TranslationIssue{}
+
+	err := b.walkSource(".", func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !b.ShouldHandle(path) {
+			return nil
+		}
+
+		var run *HTMLBuilder
+		var parts []templatePart
+		var funcs, data map[string]interface{}
+
+		switch {
+		case hb.CanHandle(path, info):
+			run, err = hb.newRun()
+			if err == nil {
+				parts, err = run.pageParts(path, info)
+			}
+			if err == nil {
+				pathOut := run.RewritePath(path)
+				data = run.GetPathData(pathOut)
+				funcs = b.pageFuncs(run, pathOut, data)
+			}
+		case mb.CanHandle(path, info):
+			var page *markdownPage
+			page, err = mb.loadPage(path)
+			if err == nil {
+				data = page.data()
+				run, parts, funcs = page.run, page.parts, page.funcs(data)
+			}
+		default:
+			return nil
+		}
+		if err != nil {
+			issue := TranslationIssue{File: path, Language: b.currentLanguage, Message: err.Error()}
+			var be *BuildError
+			if errors.As(err, &be) {
+				issue.File, issue.Line, issue.Message = be.File, be.Line, be.Message
+			}
+			issues = append(issues, issue)
+			return nil
+		}
+
+		issues = append(issues, checkTemplateVars(run, parts, funcs, data, b.currentLanguage)...)
+		return nil
+	})
+
+	return issues, err
+}
+
+// checkTemplateVars parses the parts of a page like executeTemplate and reports the fields of the page data they use but the data lacks
+func checkTemplateVars(run *HTMLBuilder, parts []templatePart, funcs map[string]interface{}, data map[string]interface{}, lang string) []TranslationIssue {
+	var t *ttemplate.Template
+	for _, part := range parts {
+		if t == nil {
+			t = ttemplate.New(part.name).Delims(`<!--#`, `-->`).Funcs(funcs)
+		} else {
+			t = t.New(part.name)
+		}
+
+		_, err := t.Parse(string(part.content))
+		if err != nil {
+			be := templateError("html", parts[0].name, err, parts)
+			return []TranslationIssue{{File: be.File, Line: be.Line, Language: lang, Message: be.Message}}
+		}
+	}
+
+	c := &varsChecker{run: run, parts: parts, lang: lang, data: data}
+	for _, tmpl := range t.Templates() {
+		if tmpl.Tree == nil {
+			continue
+		}
+		c.tree = tmpl.Tree
+		c.walk(tmpl.Tree.Root, data)
+	}
+	return c.issues
+}
+
+type varsChecker struct {
+	run    *HTMLBuilder
+	parts  []templatePart
+	lang   string
+	data   map[string]interface{} // Page data, the one t looks keys up in
+	tree   *parse.Tree
+	issues []TranslationIssue
+}
+
+// walk checks the node against dot, the data of its scope.
+// A nil dot is an unknown scope, such as the body of a range, where nothing is checked.
+func (c *varsChecker) walk(node parse.Node, dot map[string]interface{}) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, sub := range n.Nodes {
+			c.walk(sub, dot)
+		}
+	case *parse.ActionNode:
+		c.walk(n.Pipe, dot)
+	case *parse.IfNode:
+		c.walkCondition(n.Pipe, dot)
+		c.walk(n.List, dot)
+		c.walk(n.ElseList, dot)
+	case *parse.WithNode:
+		c.walkCondition(n.Pipe, dot)
+		c.walk(n.List, c.importScope(n.Pipe, dot))
+		c.walk(n.ElseList, dot)
+	case *parse.RangeNode:
+		c.walk(n.Pipe, dot)
+		c.walk(n.List, nil)
+		c.walk(n.ElseList, dot)
+	case *parse.TemplateNode:
+		c.walk(n.Pipe, dot)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for k, cmd := range n.Cmds {
+			// A var piped to default is optional
+			if k+1 < len(n.Cmds) && commandName(n.Cmds[k+1]) == "default" && len(cmd.Args) == 1 {
+				if _, ok := cmd.Args[0].(*parse.FieldNode); ok {
+					continue
+				}
+			}
+			c.walk(cmd, dot)
+		}
+	case *parse.CommandNode:
+		switch commandName(n) {
+		case "default":
+			return
+		case "t":
+			// t "key" looks the key up in the page data
+			if len(n.Args) > 1 {
+				if key, ok := n.Args[1].(*parse.StringNode); ok {
+					c.checkField(key.Position(), strings.Split(key.Text, "."), c.data)
+				}
+			}
+		}
+		for _, arg := range n.Args {
+			c.walk(arg, dot)
+		}
+	case *parse.ChainNode:
+		c.walk(n.Node, dot)
+	case *parse.FieldNode:
+		c.checkField(n.Position(), n.Ident, dot)
+	case *parse.VariableNode:
+		if n.Ident[0] == "$" && len(n.Ident) > 1 {
+			c.checkField(n.Position(), n.Ident[1:], dot)
+		}
+	}
+}
+
+// commandName returns the name of the function a command calls, if any
+func commandName(cmd *parse.CommandNode) string {
+	if ident, ok := cmd.Args[0].(*parse.IdentifierNode); ok {
+		return ident.Ident
+	}
+	return ""
+}
+
+// walkCondition checks the condition of an if or a with,
+// a condition made of a single field only tests whether the var is set and isn't checked
+func (c *varsChecker) walkCondition(pipe *parse.PipeNode, dot map[string]interface{}) {
+	if len(pipe.Cmds) == 1 && len(pipe.Cmds[0].Args) == 1 {
+		if _, ok := pipe.Cmds[0].Args[0].(*parse.FieldNode); ok {
+			return
+		}
+	}
+	c.walk(pipe, dot)
+}
+
+// importScope returns the data of the body of a with: the import scope for the parameterised imports, unknown otherwise
+func (c *varsChecker) importScope(pipe *parse.PipeNode, dot map[string]interface{}) map[string]interface{} {
+	if dot == nil || len(pipe.Cmds) != 1 || len(pipe.Cmds[0].Args) != 3 {
+		return nil
+	}
+	args := pipe.Cmds[0].Args
+	if ident, ok := args[0].(*parse.IdentifierNode); !ok || ident.Ident != "toastfrontImport" {
+		return nil
+	}
+	i, ok := args[2].(*parse.NumberNode)
+	if !ok || !i.IsInt || int(i.Int64) >= len(*c.run.importArgs) {
+		return nil
+	}
+	return c.run.importScope(dot, int(i.Int64))
+}
+
+func (c *varsChecker) checkField(pos parse.Pos, ident []string, dot map[string]interface{}) {
+	if dot == nil {
+		return
+	}
+
+	data := dot
+	for i, k := range ident {
+		v, ok := data[k]
+		if !ok {
+			c.report(pos, fmt.Sprintf("undefined var %q", strings.Join(ident[:i+1], ".")))
+			return
+		}
+		if data, ok = v.(map[string]interface{}); !ok {
+			return
+		}
+	}
+}
+
+func (c *varsChecker) report(pos parse.Pos, message string) {
+	for _, part := range c.parts {
+		if part.name == c.tree.ParseName {
+			origin := lineOrigin(part.name, part.content, part.lines, int(pos))
+			c.issues = append(c.issues, TranslationIssue{File: origin.File, Line: origin.Line, Language: c.lang, Message: message})
+			return
+		}
+	}
+	c.issues = append(c.issues, TranslationIssue{File: c.tree.ParseName, Language: c.lang, Message: message})
+}
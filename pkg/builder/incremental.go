@@ -0,0 +1,268 @@
+package builder
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/toastate/toastfront/internal/tlogger"
+)
+
+// BuildChanged rebuilds the given files and every file importing them (directly or not),
+// using the dependency graph filled during the previous build.
+// Paths can be absolute or relative to the working directory, as reported by the watcher.
+// A full Build is run instead when a change can't be resolved file by file (vars, builder config files, .env files).
+func (b *Builder) BuildChanged(paths []string) error {
+	if !b.built || b.opts.HashAssets {
+		return b.Build()
+	}
+
+	changed := make([]string, 0, len(paths))
+	for _, p := range paths {
+		rel, ok := b.relSrcPath(p)
+		if !ok || b.requiresFullBuild(rel) || b.isEnvFile(p) {
+			tlogger.Debug("msg", "Full rebuild required", "path", p)
+			return b.Build()
+		}
+		changed = append(changed, rel)
+	}
+	// New directories are created before the files they contain
+	sort.Strings(changed)
+
+	tlogger.Info("msg", "Incremental build started", "files", len(changed))
+	defer tlogger.Info("msg", "Incremental build finished", "files", len(changed))
+
+	b.resetDiagnostics()
+	defer b.logDiagnosticsSummary()
+
+	err := b.rebuildFiles(changed)
+	for _, subBuilder := range b.subBuilders {
+		if err != nil && !b.opts.KeepGoing {
+			break
+		}
+		subErr := subBuilder.rebuildFiles(changed)
+		if err == nil {
+			err = subErr
+		}
+	}
+	if errs := b.diagnostics.err(); errs != nil {
+		err = errs
+	}
+	if err != nil {
+		// Files after the failing one weren't rebuilt, the next change triggers a full build
+		b.built = false
+		return err
+	}
+
+	// Pages may have been added or removed
+	if b.opts.Sitemap {
+		return b.writeSitemap()
+	}
+	return nil
+}
+
+func (b *Builder) rebuildFiles(changed []string) error {
+	affected := b.dependents(changed)
+
+	for _, path := range affected {
+		b.clearDeps(path)
+	}
+
+	for _, path := range affected {
+		info, err := b.statSource(path)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				b.removeOutputs(path)
+				continue
+			}
+			tlogger.Error("msg", "Can't stat changed file", "path", path, "err", err)
+			return err
+		}
+
+		err = b.processFile(path, info)
+		if err != nil && !b.opts.KeepGoing {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// dependents returns the given paths followed by all the files importing them, transitively
+func (b *Builder) dependents(paths []string) []string {
+	b.depsMu.Lock()
+	defer b.depsMu.Unlock()
+
+	seen := map[string]struct{}{}
+	out := []string{}
+
+	queue := append([]string{}, paths...)
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+
+		if _, ok := seen[p]; ok {
+			continue
+		}
+		seen[p] = struct{}{}
+		out = append(out, p)
+
+		for importer := range b.fileDeps[p] {
+			queue = append(queue, importer)
+		}
+	}
+
+	return out
+}
+
+// addDep records that importer imports dep
+func (b *Builder) addDep(dep, importer string) {
+	b.depsMu.Lock()
+	defer b.depsMu.Unlock()
+
+	if _, ok := b.fileDeps[dep]; ok {
+		b.fileDeps[dep][importer] = struct{}{}
+	} else {
+		b.fileDeps[dep] = map[string]struct{}{importer: {}}
+	}
+}
+
+// clearDeps forgets the imports made by path, they are registered again when it is processed
+func (b *Builder) clearDeps(path string) {
+	b.depsMu.Lock()
+	defer b.depsMu.Unlock()
+
+	for _, importers := range b.fileDeps {
+		delete(importers, path)
+	}
+}
+
+// registerSource records the output generated by fb for the source path
+func (b *Builder) registerSource(path string, fb FileBuilder) {
+	out := path
+	if rw, ok := fb.(pathRewriter); ok {
+		out = rw.RewritePath(path)
+	}
+	if out == "" {
+		return
+	}
+
+	b.outputsMu.Lock()
+	defer b.outputsMu.Unlock()
+
+	if b.sourceOutputs == nil {
+		b.sourceOutputs = map[string]string{}
+	}
+	b.sourceOutputs[path] = out
+
+	switch fb.(type) {
+	case *HTMLBuilder, *MarkdownBuilder:
+		if b.pages == nil {
+			b.pages = map[string]struct{}{}
+		}
+		b.pages[out] = struct{}{}
+	}
+}
+
+// removeOutputs deletes the outputs generated from path, or from everything under it when it was a directory
+func (b *Builder) removeOutputs(path string) {
+	b.outputsMu.Lock()
+	removed := []string{}
+	for src, out := range b.sourceOutputs {
+		if src == path || strings.HasPrefix(src, path+string(filepath.Separator)) {
+			removed = append(removed, out)
+			delete(b.sourceOutputs, src)
+			delete(b.outputs, filepath.ToSlash(out))
+			delete(b.pages, out)
+		}
+	}
+	b.outputsMu.Unlock()
+
+	// Deepest paths first, so directories are emptied before being removed
+	sort.Sort(sort.Reverse(sort.StringSlice(removed)))
+
+	for _, out := range removed {
+		// Directories still holding the outputs of other sources are kept
+		err := b.removeOutput(out)
+		b.removeOutput(out + ".map")
+		if err == nil {
+			tlogger.Info("msg", "Removed stale output", "path", out)
+		}
+	}
+}
+
+func (b *Builder) relSrcPath(path string) (string, bool) {
+	absSrc, err := filepath.Abs(b.srcDir)
+	if err != nil {
+		return "", false
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", false
+	}
+
+	rel, err := filepath.Rel(absSrc, absPath)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return rel, true
+}
+
+func (b *Builder) requiresFullBuild(path string) bool {
+	varsDir := *b.varsDirectory
+	if varsDir == "" || varsDir == "." {
+		name := filepath.Base(path)
+		if name == "common.json" || (strings.HasPrefix(name, "lang-") && filepath.Ext(name) == ".json") {
+			return true
+		}
+	} else if path == varsDir || strings.HasPrefix(path, varsDir+string(filepath.Separator)) {
+		return true
+	}
+
+	if cb, ok := b.fileBuilders["css"].(*CSSBuilder); ok && path == filepath.Join(cb.folder, cb.varsFile) {
+		return true
+	}
+	if jb, ok := b.fileBuilders["js"].(*JSBuilder); ok && path == filepath.Join(jb.folder, jb.VarsFile) {
+		return true
+	}
+
+	return false
+}
+
+// StylesheetOutputs returns the URL paths, relative to the language root, of the stylesheets affected by the
+// changed source files. ok is false when any of the changes isn't a stylesheet, in which case pages must be reloaded.
+// Pages are reloaded as well when the assets are hashed, the stylesheets they link are renamed by every change.
+func (b *Builder) StylesheetOutputs(paths []string) (outputs []string, ok bool) {
+	cb, isCSS := b.fileBuilders["css"].(*CSSBuilder)
+	if !isCSS || (b.opts != nil && b.opts.HashAssets) {
+		return nil, false
+	}
+
+	changed := make([]string, 0, len(paths))
+	for _, p := range paths {
+		rel, ok := b.relSrcPath(p)
+		if !ok || b.requiresFullBuild(rel) {
+			return nil, false
+		}
+		// Pages still linking a removed stylesheet are reloaded
+		info, err := b.statSource(rel)
+		if err != nil || !cb.IsCssFile(rel, info) {
+			return nil, false
+		}
+		changed = append(changed, rel)
+	}
+
+	for _, p := range b.dependents(changed) {
+		if !b.ShouldHandle(p) {
+			continue
+		}
+		if info, err := b.statSource(p); err != nil || !cb.IsCssFile(p, info) {
+			continue
+		}
+		outputs = append(outputs, "/"+filepath.ToSlash(p))
+	}
+
+	return outputs, true
+}
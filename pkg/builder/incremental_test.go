@@ -0,0 +1,171 @@
+package builder
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func newTestSource() fstest.MapFS {
+	return fstest.MapFS{
+		"html/index.html":           {Data: []byte(`<body><!--#import /includes/header.html--><h1><!--#.title--></h1></body>`)},
+		"html/about.html":           {Data: []byte(`<body><!--#import /includes/header.html-->about</body>`)},
+		"html/includes/header.html": {Data: []byte(`<header>v1</header>`)},
+		"html/vars/common.json":     {Data: []byte(`{"title": "Home"}`)},
+		"css/main.css":              {Data: []byte("@import \"local://includes/base.css\";\nmain { color: red; }\n")},
+		"css/includes/base.css":     {Data: []byte("body { margin: 0; }\n")},
+		"js/main.js":                {Data: []byte("console.log(1);\n")},
+		"assets/logo.svg":           {Data: []byte(`<svg></svg>`)},
+	}
+}
+
+func TestBuildChanged(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(src fstest.MapFS)
+		changed []string
+		want    map[string]string // Output name to a substring of its content
+		removed []string
+	}{
+		{
+			name: "include",
+			change: func(src fstest.MapFS) {
+				src["html/includes/header.html"] = &fstest.MapFile{Data: []byte(`<header>v2</header>`)}
+			},
+			changed: []string{"html/includes/header.html"},
+			want:    map[string]string{"index.html": "<header>v2</header>", "about.html": "<header>v2</header>"},
+		},
+		{
+			name: "page",
+			change: func(src fstest.MapFS) {
+				src["html/about.html"] = &fstest.MapFile{Data: []byte(`<body>about v2</body>`)}
+			},
+			changed: []string{"html/about.html"},
+			want:    map[string]string{"about.html": "about v2", "index.html": "<header>v1</header>"},
+		},
+		{
+			name: "css include",
+			change: func(src fstest.MapFS) {
+				src["css/includes/base.css"] = &fstest.MapFile{Data: []byte("body { margin: 1px; }\n")}
+			},
+			changed: []string{"css/includes/base.css"},
+			want:    map[string]string{"css/main.css": "margin: 1px"},
+		},
+		{
+			name: "vars",
+			change: func(src fstest.MapFS) {
+				src["html/vars/common.json"] = &fstest.MapFile{Data: []byte(`{"title": "Welcome"}`)}
+			},
+			changed: []string{"html/vars/common.json"},
+			want:    map[string]string{"index.html": "<h1>Welcome</h1>"},
+		},
+		{
+			name: "new page",
+			change: func(src fstest.MapFS) {
+				src["html/contact.html"] = &fstest.MapFile{Data: []byte(`<body>contact</body>`)}
+			},
+			changed: []string{"html/contact.html"},
+			want:    map[string]string{"contact.html": "contact"},
+		},
+		{
+			name: "removed page",
+			change: func(src fstest.MapFS) {
+				delete(src, "html/about.html")
+			},
+			changed: []string{"html/about.html"},
+			want:    map[string]string{"index.html": "<header>v1</header>"},
+			removed: []string{"about.html"},
+		},
+		{
+			name: "removed script",
+			change: func(src fstest.MapFS) {
+				delete(src, "js/main.js")
+			},
+			changed: []string{"js/main.js"},
+			removed: []string{"js/main.js"},
+		},
+		{
+			name: "removed asset",
+			change: func(src fstest.MapFS) {
+				delete(src, "assets/logo.svg")
+			},
+			changed: []string{"assets/logo.svg"},
+			removed: []string{"assets/logo.svg"},
+		},
+	}
+
+	for _, tt := range tests {
+		src := newTestSource()
+		out := NewMemoryOutput()
+		b := NewBuilderFS(src, out, t.TempDir())
+
+		err := b.Init()
+		if err != nil {
+			t.Fatalf("%s: init: %v", tt.name, err)
+		}
+		err = b.Build()
+		if err != nil {
+			t.Fatalf("%s: build: %v", tt.name, err)
+		}
+
+		tt.change(src)
+		paths := make([]string, 0, len(tt.changed))
+		for _, p := range tt.changed {
+			paths = append(paths, filepath.Join(b.srcDir, filepath.FromSlash(p)))
+		}
+		err = b.BuildChanged(paths)
+		if err != nil {
+			t.Errorf("%s: BuildChanged: %v", tt.name, err)
+			continue
+		}
+
+		files := out.Files()
+		for name, want := range tt.want {
+			content, ok := files[name]
+			if !ok {
+				t.Errorf("%s: %s is missing", tt.name, name)
+			} else if !strings.Contains(string(content), want) {
+				t.Errorf("%s: %s = %q, want it to contain %q", tt.name, name, content, want)
+			}
+		}
+		for _, name := range tt.removed {
+			if _, ok := files[name]; ok {
+				t.Errorf("%s: %s wasn't removed", tt.name, name)
+			}
+		}
+	}
+}
+
+func TestBuildChangedError(t *testing.T) {
+	src := newTestSource()
+	out := NewMemoryOutput()
+	b := NewBuilderFS(src, out, t.TempDir())
+
+	err := b.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src["html/about.html"] = &fstest.MapFile{Data: []byte(`<body><!--#if .title-->about</body>`)}
+	err = b.BuildChanged([]string{filepath.Join(b.srcDir, "html", "about.html")})
+	if err == nil {
+		t.Fatal("BuildChanged with a broken template should fail")
+	}
+	if b.built {
+		t.Error("a failed incremental build should trigger a full build on the next change")
+	}
+
+	src["html/about.html"] = &fstest.MapFile{Data: []byte(`<body>fixed</body>`)}
+	err = b.BuildChanged([]string{filepath.Join(b.srcDir, "html", "about.html")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := out.ReadFile("about.html"); !strings.Contains(string(content), "fixed") {
+		t.Errorf("about.html = %q after the fix", content)
+	}
+}
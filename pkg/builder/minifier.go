@@ -3,13 +3,28 @@ package builder
 import (
 	"io"
 	"regexp"
+	"sync/atomic"
 
 	"github.com/tdewolff/minify/v2"
 	"github.com/tdewolff/minify/v2/css"
 	"github.com/tdewolff/minify/v2/html"
 	"github.com/tdewolff/minify/v2/js"
+	"github.com/toastate/toastfront/internal/tlogger"
 )
 
+const (
+	MediaTypeHTML = "text/html"
+	MediaTypeCSS  = "text/css"
+	MediaTypeJS   = "application/javascript"
+)
+
+// minifyTypes maps the short names used in the configuration to media types
+var minifyTypes = map[string]string{
+	"html": MediaTypeHTML,
+	"css":  MediaTypeCSS,
+	"js":   MediaTypeJS,
+}
+
 type FileWriter interface {
 	Writer(string, io.WriteCloser) io.WriteCloser
 }
@@ -21,7 +36,41 @@ type TDMinifier struct {
 }
 
 func (m *TDMinifier) Writer(mediatype string, out io.WriteCloser) io.WriteCloser {
-	return m.Minifier.Writer(mediatype, out)
+	return &minifyWriter{
+		WriteCloser: m.Minifier.Writer(mediatype, out),
+		out:         out,
+	}
+}
+
+// minifyWriter flushes the minifier and closes the underlying output on Close
+type minifyWriter struct {
+	io.WriteCloser
+	out    io.WriteCloser
+	closed bool
+}
+
+func (w *minifyWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	err := w.WriteCloser.Close()
+	errOut := w.out.Close()
+	if err != nil {
+		return err
+	}
+	return errOut
+}
+
+// minifyBytes minifies b in one go, it is returned untouched if the file writer isn't a minifier
+func minifyBytes(mediatype string, b []byte) ([]byte, error) {
+	m, ok := filewriter.(*TDMinifier)
+	if !ok {
+		return b, nil
+	}
+	// The minifier writes after the end of its input when there is room, b may be part of a larger buffer
+	return m.Minifier.Bytes(mediatype, b[:len(b):len(b)])
 }
 
 type NOOPMinifier struct {
@@ -43,3 +92,87 @@ func init() {
 		Minifier: minifier,
 	}
 }
+
+type minifyStat struct {
+	files  int64
+	before int64
+	after  int64
+}
+
+type countingWriter struct {
+	io.WriteCloser
+	n *int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	atomic.AddInt64(w.n, int64(n))
+	return n, err
+}
+
+func (b *Builder) shouldMinify(mediatype string) bool {
+	if b.opts == nil || !b.opts.Minify {
+		return false
+	}
+	for _, v := range b.opts.MinifySkip {
+		if minifyTypes[v] == mediatype {
+			return false
+		}
+	}
+	return true
+}
+
+// outputWriter pipes out through the minifier of mediatype when minification is enabled,
+// the returned writer must be closed to flush the minified content
+func (b *Builder) outputWriter(mediatype string, out io.WriteCloser) io.WriteCloser {
+	if !b.shouldMinify(mediatype) {
+		return out
+	}
+
+	stat := b.minifyStats[mediatype]
+	if stat == nil {
+		return filewriter.Writer(mediatype, out)
+	}
+	atomic.AddInt64(&stat.files, 1)
+
+	return &countingWriter{
+		WriteCloser: filewriter.Writer(mediatype, &countingWriter{WriteCloser: out, n: &stat.after}),
+		n:           &stat.before,
+	}
+}
+
+func (b *Builder) resetMinifyStats() {
+	b.minifyStats = map[string]*minifyStat{}
+	for _, mediatype := range minifyTypes {
+		b.minifyStats[mediatype] = &minifyStat{}
+	}
+}
+
+func (b *Builder) logMinifySummary() {
+	if b.opts == nil || !b.opts.Minify {
+		return
+	}
+
+	builders := []*Builder{b}
+	for _, subBuilder := range b.subBuilders {
+		builders = append(builders, subBuilder)
+	}
+
+	for _, name := range []string{"html", "css", "js"} {
+		mediatype := minifyTypes[name]
+		if !b.shouldMinify(mediatype) {
+			continue
+		}
+
+		total := minifyStat{}
+		for _, bd := range builders {
+			if stat := bd.minifyStats[mediatype]; stat != nil {
+				total.files += stat.files
+				total.before += stat.before
+				total.after += stat.after
+			}
+		}
+
+		tlogger.Info("msg", "Minification summary", "type", name, "files", total.files, "before", total.before, "after", total.after, "saved", total.before-total.after)
+	}
+}
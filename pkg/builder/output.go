@@ -0,0 +1,629 @@
+package builder
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/toastate/toastfront/internal/tlogger"
+)
+
+// Output receives the files generated by a build. Names are slash separated and relative to the top of the site,
+// the outputs of the other languages being in their own folder.
+type Output interface {
+	// Create creates or truncates the file name, along with its parent folders
+	Create(name string) (io.WriteCloser, error)
+	// ReadFile returns the content of a file written earlier, used to hash assets
+	ReadFile(name string) ([]byte, error)
+	MkdirAll(name string) error
+	// Remove removes a file or an empty folder
+	Remove(name string) error
+	// Clear removes every file before a full build
+	Clear() error
+}
+
+func writeFile(out Output, name string, content []byte) error {
+	f, err := out.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// StagedOutput is implemented by the outputs writing full builds aside,
+// so that a failed build leaves the previous one in place
+type StagedOutput interface {
+	Output
+	// Stage starts a full build, it replaces Clear
+	Stage() error
+	// Commit replaces the previous build by the staged one, it returns a *CommitError when it fails
+	Commit() error
+	// Discard drops the staged build
+	Discard() error
+}
+
+// CommitError is returned when a staged build can't replace the previous one
+type CommitError struct {
+	Err error
+	// Restored is true when the previous build is still in place
+	Restored bool
+}
+
+func (e *CommitError) Error() string {
+	return "can't replace the previous build: " + e.Err.Error()
+}
+
+func (e *CommitError) Unwrap() error {
+	return e.Err
+}
+
+// DirOutput writes the build to a directory on disk, it is the default output.
+// Full builds are written to a sibling staging directory renamed to Dir once they succeed.
+type DirOutput struct {
+	Dir string
+
+	staging string // Staging directory of the running full build
+}
+
+func NewDirOutput(dir string) *DirOutput {
+	return &DirOutput{Dir: dir}
+}
+
+func (o *DirOutput) path(name string) string {
+	if o.staging != "" {
+		return filepath.Join(o.staging, filepath.FromSlash(name))
+	}
+	return filepath.Join(o.Dir, filepath.FromSlash(name))
+}
+
+func (o *DirOutput) Create(name string) (io.WriteCloser, error) {
+	p := o.path(name)
+	err := os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(p, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+}
+
+func (o *DirOutput) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(o.path(name))
+}
+
+func (o *DirOutput) MkdirAll(name string) error {
+	return os.MkdirAll(o.path(name), 0755)
+}
+
+func (o *DirOutput) Remove(name string) error {
+	return os.Remove(o.path(name))
+}
+
+func (o *DirOutput) Clear() error {
+	return os.RemoveAll(o.path(""))
+}
+
+// stagingPattern returns the glob pattern of the staging and backup directories of Dir
+func (o *DirOutput) stagingPattern(kind string) string {
+	dir := filepath.Clean(o.Dir)
+	return filepath.Join(filepath.Dir(dir), "."+filepath.Base(dir)+"."+kind+"-*")
+}
+
+func (o *DirOutput) Stage() error {
+	if o.staging != "" {
+		o.Discard()
+	}
+
+	// Left over by interrupted builds
+	for _, kind := range []string{"staging", "old"} {
+		leftovers, _ := filepath.Glob(o.stagingPattern(kind))
+		for _, p := range leftovers {
+			os.RemoveAll(p)
+		}
+	}
+
+	dir := filepath.Clean(o.Dir)
+	err := os.MkdirAll(filepath.Dir(dir), 0755)
+	if err != nil {
+		return err
+	}
+	staging, err := os.MkdirTemp(filepath.Dir(dir), "."+filepath.Base(dir)+".staging-")
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(staging, 0755)
+	if err != nil {
+		os.RemoveAll(staging)
+		return err
+	}
+
+	o.staging = staging
+	return nil
+}
+
+func (o *DirOutput) Commit() error {
+	if o.staging == "" {
+		return nil
+	}
+	staging := o.staging
+	o.staging = ""
+
+	dir := filepath.Clean(o.Dir)
+	_, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		err = os.Rename(staging, dir)
+		if err != nil {
+			os.RemoveAll(staging)
+			return &CommitError{Err: err, Restored: true}
+		}
+		return nil
+	}
+
+	// The previous build is moved aside first, directories can't be renamed over each other on every platform
+	oldName := strings.Replace(filepath.Base(staging), ".staging-", ".old-", 1)
+	old := filepath.Join(filepath.Dir(staging), oldName)
+	err = os.Rename(dir, old)
+	if err != nil {
+		// Dir can't be moved when it is a mount point, its content is replaced instead. The previous entries
+		// are kept in Dir itself, the staging directory may be on another filesystem.
+		tlogger.Debug("msg", "Can't move the previous build aside, replacing its content", "path", dir, "err", err)
+		err = replaceDirContent(dir, staging, filepath.Join(dir, oldName))
+		if err != nil {
+			os.RemoveAll(staging)
+		}
+		return err
+	}
+
+	err = os.Rename(staging, dir)
+	if err != nil {
+		os.RemoveAll(staging)
+		errRestore := os.Rename(old, dir)
+		if errRestore != nil {
+			tlogger.Error("msg", "Can't restore the previous build", "path", old, "err", errRestore)
+			return &CommitError{Err: err}
+		}
+		return &CommitError{Err: err, Restored: true}
+	}
+
+	err = os.RemoveAll(old)
+	if err != nil {
+		tlogger.Warn("msg", "Can't remove the previous build", "path", old, "err", err)
+	}
+	return nil
+}
+
+func (o *DirOutput) Discard() error {
+	if o.staging == "" {
+		return nil
+	}
+	staging := o.staging
+	o.staging = ""
+	return os.RemoveAll(staging)
+}
+
+// replaceDirContent replaces the content of dir by the one of src. The previous entries are moved to old,
+// a directory created in dir, until the new ones are in place so that they can be put back when the replacement fails.
+func replaceDirContent(dir, src, old string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return &CommitError{Err: err, Restored: true}
+	}
+	names := []string{}
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+
+	err = os.Mkdir(old, 0755)
+	if err != nil {
+		return &CommitError{Err: err, Restored: true}
+	}
+
+	previous, err := moveEntries(dir, old, names)
+	if err != nil {
+		return restoreDirContent(dir, old, nil, previous, err)
+	}
+
+	current, err := moveEntries(src, dir, nil)
+	if err != nil {
+		return restoreDirContent(dir, old, current, previous, err)
+	}
+
+	os.RemoveAll(old)
+	return os.RemoveAll(src)
+}
+
+// restoreDirContent undoes a failed replaceDirContent: the entries current already moved to dir are removed,
+// and the entries previous are moved back from old
+func restoreDirContent(dir, old string, current, previous []string, err error) error {
+	for _, name := range current {
+		errRemove := os.RemoveAll(filepath.Join(dir, name))
+		if errRemove != nil {
+			tlogger.Error("msg", "Can't restore the previous build", "path", old, "err", errRemove)
+			return &CommitError{Err: err}
+		}
+	}
+
+	_, errRestore := moveEntries(old, dir, previous)
+	if errRestore != nil {
+		tlogger.Error("msg", "Can't restore the previous build", "path", old, "err", errRestore)
+		return &CommitError{Err: err}
+	}
+	os.RemoveAll(old)
+	return &CommitError{Err: err, Restored: true}
+}
+
+// moveEntries moves the entries names of from to to, or all of them when names is nil.
+// It stops at the first failure and returns the entries moved so far.
+func moveEntries(from, to string, names []string) ([]string, error) {
+	if names == nil {
+		entries, err := os.ReadDir(from)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+	}
+
+	moved := make([]string, 0, len(names))
+	for _, name := range names {
+		err := moveEntry(filepath.Join(from, name), filepath.Join(to, name))
+		if err != nil {
+			return moved, err
+		}
+		moved = append(moved, name)
+	}
+	return moved, nil
+}
+
+// moveEntry renames from to to, or copies it when they are on different filesystems
+func moveEntry(from, to string) error {
+	err := os.Rename(from, to)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	err = copyTree(from, to)
+	if err != nil {
+		os.RemoveAll(to)
+		return err
+	}
+	return os.RemoveAll(from)
+}
+
+// copyTree copies the file or directory from to to, with its permissions
+func copyTree(from, to string) error {
+	return filepath.WalkDir(from, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(from, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(to, rel)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case info.IsDir():
+			return os.Mkdir(target, info.Mode().Perm())
+		case info.Mode()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		}
+
+		src, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		dst, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(dst, src)
+		errClose := dst.Close()
+		if err != nil {
+			return err
+		}
+		return errClose
+	})
+}
+
+// MemoryOutput keeps the build in memory
+type MemoryOutput struct {
+	mu    sync.RWMutex
+	files map[string][]byte
+	dirs  map[string]struct{}
+}
+
+func NewMemoryOutput() *MemoryOutput {
+	return &MemoryOutput{
+		files: map[string][]byte{},
+		dirs:  map[string]struct{}{},
+	}
+}
+
+// Files returns a copy of the generated files, by name
+func (o *MemoryOutput) Files() map[string][]byte {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	out := make(map[string][]byte, len(o.files))
+	for k, v := range o.files {
+		out[k] = v
+	}
+	return out
+}
+
+// Dirs returns the sorted names of the folders
+func (o *MemoryOutput) Dirs() []string {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	out := make([]string, 0, len(o.dirs))
+	for k := range o.dirs {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (o *MemoryOutput) Create(name string) (io.WriteCloser, error) {
+	name = path.Clean(name)
+	o.mu.Lock()
+	o.addDirs(path.Dir(name))
+	o.mu.Unlock()
+
+	return &memoryFile{output: o, name: name}, nil
+}
+
+func (o *MemoryOutput) ReadFile(name string) ([]byte, error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	content, ok := o.files[path.Clean(name)]
+	if !ok {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrNotExist}
+	}
+	return content, nil
+}
+
+func (o *MemoryOutput) MkdirAll(name string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.addDirs(path.Clean(name))
+	return nil
+}
+
+// addDirs adds name and its parents, the caller holds the lock
+func (o *MemoryOutput) addDirs(name string) {
+	for name != "." && name != "/" && name != "" {
+		o.dirs[name] = struct{}{}
+		name = path.Dir(name)
+	}
+}
+
+func (o *MemoryOutput) Remove(name string) error {
+	name = path.Clean(name)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if _, ok := o.files[name]; ok {
+		delete(o.files, name)
+		return nil
+	}
+	if _, ok := o.dirs[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+
+	prefix := name + "/"
+	for k := range o.files {
+		if strings.HasPrefix(k, prefix) {
+			return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrExist}
+		}
+	}
+	for k := range o.dirs {
+		if strings.HasPrefix(k, prefix) {
+			return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrExist}
+		}
+	}
+	delete(o.dirs, name)
+	return nil
+}
+
+func (o *MemoryOutput) Clear() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.files = map[string][]byte{}
+	o.dirs = map[string]struct{}{}
+	return nil
+}
+
+// Snapshot returns a read only copy of the current files, later writes don't change it
+func (o *MemoryOutput) Snapshot() fs.FS {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	snap := &memoryFS{files: make(map[string][]byte, len(o.files)), dirs: make(map[string]struct{}, len(o.dirs)), modTime: time.Now()}
+	for k, v := range o.files {
+		snap.files[k] = v
+	}
+	for k := range o.dirs {
+		snap.dirs[k] = struct{}{}
+	}
+	return snap
+}
+
+// memoryFile stores its content in the output when closed
+type memoryFile struct {
+	bytes.Buffer
+	output *MemoryOutput
+	name   string
+	closed bool
+}
+
+func (f *memoryFile) Close() error {
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+
+	f.output.mu.Lock()
+	f.output.files[f.name] = f.Bytes()
+	f.output.mu.Unlock()
+	return nil
+}
+
+// ArchiveOutput keeps the build in memory and writes it as a zip or tar archive on Close,
+// once the build and the asset hashing are done
+type ArchiveOutput struct {
+	*MemoryOutput
+
+	w     io.Writer
+	write func(w io.Writer, o *MemoryOutput) error
+}
+
+// NewZipOutput returns an output writing a zip archive of the build to w
+func NewZipOutput(w io.Writer) *ArchiveOutput {
+	return &ArchiveOutput{MemoryOutput: NewMemoryOutput(), w: w, write: writeZip}
+}
+
+// NewTarOutput returns an output writing a tar archive of the build to w, wrap w with gzip for a .tar.gz
+func NewTarOutput(w io.Writer) *ArchiveOutput {
+	return &ArchiveOutput{MemoryOutput: NewMemoryOutput(), w: w, write: writeTar}
+}
+
+// Close writes the archive, it doesn't close the underlying writer
+func (o *ArchiveOutput) Close() error {
+	return o.write(o.w, o.MemoryOutput)
+}
+
+func sortedFiles(files map[string][]byte) []string {
+	names := make([]string, 0, len(files))
+	for k := range files {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func writeZip(w io.Writer, o *MemoryOutput) error {
+	zw := zip.NewWriter(w)
+	for _, dir := range o.Dirs() {
+		_, err := zw.Create(dir + "/")
+		if err != nil {
+			return err
+		}
+	}
+
+	files := o.Files()
+	for _, name := range sortedFiles(files) {
+		f, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(files[name])
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func writeTar(w io.Writer, o *MemoryOutput) error {
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	for _, dir := range o.Dirs() {
+		err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: dir + "/", Mode: 0755, ModTime: now})
+		if err != nil {
+			return err
+		}
+	}
+
+	files := o.Files()
+	for _, name := range sortedFiles(files) {
+		err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: int64(len(files[name])), ModTime: now})
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(files[name])
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// memoryFS is a snapshot of a MemoryOutput. File contents are shared with the output,
+// which never modifies them as every write replaces the content.
+type memoryFS struct {
+	files   map[string][]byte
+	dirs    map[string]struct{}
+	modTime time.Time
+}
+
+func (m *memoryFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	if content, ok := m.files[name]; ok {
+		return &memoryFSFile{Reader: bytes.NewReader(content), info: memoryFileInfo{name: path.Base(name), size: int64(len(content)), modTime: m.modTime}}, nil
+	}
+	if _, ok := m.dirs[name]; ok || name == "." {
+		return &memoryFSFile{Reader: bytes.NewReader(nil), info: memoryFileInfo{name: path.Base(name), dir: true, modTime: m.modTime}}, nil
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+type memoryFSFile struct {
+	*bytes.Reader
+	info memoryFileInfo
+}
+
+func (f *memoryFSFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *memoryFSFile) Close() error               { return nil }
+
+type memoryFileInfo struct {
+	name    string
+	size    int64
+	dir     bool
+	modTime time.Time
+}
+
+func (i memoryFileInfo) Name() string       { return i.name }
+func (i memoryFileInfo) Size() int64        { return i.size }
+func (i memoryFileInfo) ModTime() time.Time { return i.modTime }
+func (i memoryFileInfo) IsDir() bool        { return i.dir }
+func (i memoryFileInfo) Sys() interface{}   { return nil }
+
+func (i memoryFileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
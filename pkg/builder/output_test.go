@@ -0,0 +1,279 @@
+package builder
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"testing/fstest"
+)
+
+func TestBuildFS(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(src fstest.MapFS)
+		want   []string
+	}{
+		{
+			name:   "build",
+			change: func(src fstest.MapFS) {},
+			want:   []string{"about.html", "assets/logo.svg", "css/main.css", "index.html", "js/main.js"},
+		},
+		{
+			name: "stale outputs",
+			change: func(src fstest.MapFS) {
+				delete(src, "html/about.html")
+				delete(src, "assets/logo.svg")
+			},
+			want: []string{"css/main.css", "index.html", "js/main.js"},
+		},
+		{
+			name: "new outputs",
+			change: func(src fstest.MapFS) {
+				src["html/blog/index.html"] = &fstest.MapFile{Data: []byte(`<body>blog</body>`)}
+			},
+			want: []string{"about.html", "assets/logo.svg", "blog/index.html", "css/main.css", "index.html", "js/main.js"},
+		},
+	}
+
+	for _, tt := range tests {
+		src := newTestSource()
+		out := NewMemoryOutput()
+		b := NewBuilderFS(src, out, t.TempDir())
+
+		err := b.Init()
+		if err != nil {
+			t.Fatalf("%s: init: %v", tt.name, err)
+		}
+		err = b.Build()
+		if err != nil {
+			t.Fatalf("%s: build: %v", tt.name, err)
+		}
+
+		tt.change(src)
+		err = b.Build()
+		if err != nil {
+			t.Errorf("%s: rebuild: %v", tt.name, err)
+			continue
+		}
+
+		got := sortedFiles(out.Files())
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMemoryOutputRemove(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want []string
+	}{
+		{"css/main.css", nil, []string{"css/other.css", "index.html"}},
+		{"css", fs.ErrExist, []string{"css/main.css", "css/other.css", "index.html"}},
+		{"missing.html", fs.ErrNotExist, []string{"css/main.css", "css/other.css", "index.html"}},
+	}
+
+	for _, tt := range tests {
+		out := NewMemoryOutput()
+		for _, name := range []string{"index.html", "css/main.css", "css/other.css"} {
+			err := writeFile(out, name, []byte(name))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err := out.Remove(tt.name)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("Remove(%s) = %v, want %v", tt.name, err, tt.err)
+		}
+		got := sortedFiles(out.Files())
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Remove(%s): got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	out := NewMemoryOutput()
+	out.MkdirAll("css/empty")
+	err := out.Remove("css/empty")
+	if err != nil {
+		t.Errorf("Remove of an empty folder: %v", err)
+	}
+	if got := out.Dirs(); !reflect.DeepEqual(got, []string{"css"}) {
+		t.Errorf("Dirs() = %v, want [css]", got)
+	}
+}
+
+// dirFiles returns the slash separated names of the files under dir
+func dirFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	names := []string{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			rel, _ := filepath.Rel(dir, p)
+			names = append(names, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestBuildStaged(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(src fstest.MapFS)
+		wantErr bool
+		want    []string
+		index   string // Expected content of index.html
+	}{
+		{
+			name: "success",
+			change: func(src fstest.MapFS) {
+				delete(src, "html/about.html")
+				src["html/vars/common.json"] = &fstest.MapFile{Data: []byte(`{"title": "Welcome"}`)}
+			},
+			want:  []string{"assets/logo.svg", "css/main.css", "index.html", "js/main.js"},
+			index: "<body><header>v1</header>\n<h1>Welcome</h1></body>",
+		},
+		{
+			name: "failure",
+			change: func(src fstest.MapFS) {
+				delete(src, "html/about.html")
+				src["html/vars/common.json"] = &fstest.MapFile{Data: []byte(`{"title": "Welcome"}`)}
+				src["html/broken.html"] = &fstest.MapFile{Data: []byte(`<!--#if .title-->`)}
+			},
+			wantErr: true,
+			want:    []string{"about.html", "assets/logo.svg", "css/main.css", "index.html", "js/main.js"},
+			index:   "<body><header>v1</header>\n<h1>Home</h1></body>",
+		},
+	}
+
+	for _, tt := range tests {
+		root := t.TempDir()
+		dir := filepath.Join(root, "build")
+		src := newTestSource()
+		b := NewBuilderFS(src, NewDirOutput(dir), root)
+
+		err := b.Init()
+		if err != nil {
+			t.Fatalf("%s: init: %v", tt.name, err)
+		}
+		err = b.Build()
+		if err != nil {
+			t.Fatalf("%s: build: %v", tt.name, err)
+		}
+
+		tt.change(src)
+		err = b.Build()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: rebuild error = %v, want an error: %v", tt.name, err, tt.wantErr)
+		}
+
+		if got := dirFiles(t, dir); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+		if content, _ := os.ReadFile(filepath.Join(dir, "index.html")); string(content) != tt.index {
+			t.Errorf("%s: index.html = %q, want %q", tt.name, content, tt.index)
+		}
+		if leftovers, _ := filepath.Glob(filepath.Join(root, ".build.*")); len(leftovers) > 0 {
+			t.Errorf("%s: staging directories left over: %v", tt.name, leftovers)
+		}
+	}
+}
+
+func TestDirOutputCommit(t *testing.T) {
+	tests := []struct {
+		name     string
+		previous []string // Files of the previous build, nil when there is none
+		commit   bool
+		want     []string
+	}{
+		{"first build", nil, true, []string{"a/new.txt", "new.txt"}},
+		{"commit", []string{"old.txt", "a/old.txt"}, true, []string{"a/new.txt", "new.txt"}},
+		{"discard", []string{"old.txt", "a/old.txt"}, false, []string{"a/old.txt", "old.txt"}},
+	}
+
+	for _, tt := range tests {
+		root := t.TempDir()
+		dir := filepath.Join(root, "build")
+		for _, name := range tt.previous {
+			p := filepath.Join(dir, filepath.FromSlash(name))
+			err := os.MkdirAll(filepath.Dir(p), 0755)
+			if err == nil {
+				err = os.WriteFile(p, []byte(name), 0644)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		out := NewDirOutput(dir)
+		err := out.Stage()
+		if err != nil {
+			t.Fatalf("%s: stage: %v", tt.name, err)
+		}
+		for _, name := range []string{"new.txt", "a/new.txt"} {
+			err = out.MkdirAll(path.Dir(name))
+			if err == nil {
+				err = writeFile(out, name, []byte(name))
+			}
+			if err != nil {
+				t.Fatalf("%s: write %s: %v", tt.name, name, err)
+			}
+		}
+
+		if tt.commit {
+			err = out.Commit()
+		} else {
+			err = out.Discard()
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+
+		if got := dirFiles(t, dir); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+		if leftovers, _ := filepath.Glob(filepath.Join(root, ".build.*")); len(leftovers) > 0 {
+			t.Errorf("%s: staging directories left over: %v", tt.name, leftovers)
+		}
+	}
+}
+
+func TestReplaceDirContent(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "build")
+	src := filepath.Join(root, "staging")
+	for _, p := range []string{filepath.Join(dir, "a", "old.txt"), filepath.Join(dir, "old.txt"), filepath.Join(src, "a", "new.txt"), filepath.Join(src, "new.txt")} {
+		err := os.MkdirAll(filepath.Dir(p), 0755)
+		if err == nil {
+			err = os.WriteFile(p, []byte(filepath.Base(p)), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := replaceDirContent(dir, src, filepath.Join(dir, ".old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := dirFiles(t, dir), []string{"a/new.txt", "new.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Errorf("%s wasn't removed: %v", src, err)
+	}
+}
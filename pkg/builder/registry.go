@@ -0,0 +1,159 @@
+package builder
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+)
+
+// Priorities of the built-in file builders. A file is processed by the first builder, by ascending priority, able to handle it.
+const (
+	PriorityFolder   = 100
+	PriorityCSS      = 200
+	PriorityHTML     = 300
+	PriorityMarkdown = 400
+	PriorityJS       = 500
+	PriorityCopy     = 1000 // Copies every file the other builders didn't handle
+)
+
+var ErrAlreadyInitialized = errors.New("builder already initialized")
+
+// FileBuilderFactory creates a file builder working in ctx,
+// it is called for the builder of every language
+type FileBuilderFactory func(ctx *BuildContext) FileBuilder
+
+// namedFileBuilder keeps the name of a file builder for its errors,
+// custom builders aren't necessarily comparable to look it up in fileBuilders
+type namedFileBuilder struct {
+	name string
+	fb   FileBuilder
+}
+
+type fileBuilderRegistration struct {
+	name     string
+	priority int
+	factory  FileBuilderFactory
+}
+
+// RegisterFileBuilder adds a custom file builder, such as one generating SVG sprites or rendering YAML data.
+// Pick the priority relative to the built-in ones, a builder with PriorityCSS - 1 gets the CSS files before the CSS builder.
+// File builders implementing RewritePath(string) string declare their output path, so it gets removed with its source.
+func (b *Builder) RegisterFileBuilder(name string, priority int, factory FileBuilderFactory) error {
+	if b.initialized {
+		return ErrAlreadyInitialized
+	}
+	if factory == nil {
+		return fmt.Errorf("file builder %s has no factory", name)
+	}
+	if _, ok := builtinPriorities[name]; ok {
+		return fmt.Errorf("file builder name %s is used by a built-in builder", name)
+	}
+	for _, r := range b.registrations {
+		if r.name == name {
+			return fmt.Errorf("file builder %s is already registered", name)
+		}
+	}
+
+	b.registrations = append(b.registrations, fileBuilderRegistration{name: name, priority: priority, factory: factory})
+	return nil
+}
+
+var builtinPriorities = map[string]int{
+	"folder":   PriorityFolder,
+	"css":      PriorityCSS,
+	"html":     PriorityHTML,
+	"markdown": PriorityMarkdown,
+	"js":       PriorityJS,
+	"copy":     PriorityCopy,
+}
+
+// initFileBuilders creates the built-in and the registered file builders, ordered by priority
+func (b *Builder) initFileBuilders() {
+	b.fileBuilders = map[string]FileBuilder{
+		"folder":   &FolderBuilder{builder: b},
+		"css":      &CSSBuilder{builder: b},
+		"html":     &HTMLBuilder{builder: b},
+		"markdown": &MarkdownBuilder{builder: b},
+		"js":       &JSBuilder{builder: b},
+		// "vendor": &VendorBuilder{builder: b},
+		"copy": &CopyBuilder{builder: b},
+	}
+
+	ctx := &BuildContext{b: b}
+	for _, r := range b.registrations {
+		b.fileBuilders[r.name] = r.factory(ctx)
+	}
+
+	ordered := []fileBuilderRegistration{}
+	for name, priority := range builtinPriorities {
+		ordered = append(ordered, fileBuilderRegistration{name: name, priority: priority})
+	}
+	// Built-in builders go first on equal priorities
+	ordered = append(ordered, b.registrations...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].priority < ordered[j].priority
+	})
+
+	b.fileBuildersArray = make([]namedFileBuilder, 0, len(ordered))
+	for _, r := range ordered {
+		b.fileBuildersArray = append(b.fileBuildersArray, namedFileBuilder{name: r.name, fb: b.fileBuilders[r.name]})
+	}
+}
+
+// BuildContext gives the custom file builders access to the builder running them
+type BuildContext struct {
+	b *Builder
+}
+
+// SrcDir returns the source directory, the paths given to the file builders are relative to it.
+// Use ReadFile rather than reading it, the source may not be on disk.
+func (c *BuildContext) SrcDir() string {
+	return c.b.srcDir
+}
+
+// BuildDir returns the output directory of the language being built, use Create rather than writing to it
+func (c *BuildContext) BuildDir() string {
+	return c.b.buildDir
+}
+
+// ReadFile returns the content of a source file
+func (c *BuildContext) ReadFile(path string) ([]byte, error) {
+	return c.b.readSource(path)
+}
+
+// Source returns the source tree
+func (c *BuildContext) Source() fs.FS {
+	return c.b.src
+}
+
+// Create creates the output file path, relative to the output directory of the language being built
+func (c *BuildContext) Create(path string) (io.WriteCloser, error) {
+	return c.b.createOutput(path)
+}
+
+// Language returns the language being built
+func (c *BuildContext) Language() string {
+	return c.b.currentLanguage
+}
+
+// Env returns the language env, as given to the templates
+func (c *BuildContext) Env(pagePath string) BuildEnv {
+	return c.b.BuildEnv(pagePath)
+}
+
+// OutputWriter wraps out to minify what is written to it when the build minifies mediatype
+func (c *BuildContext) OutputWriter(mediatype string, out io.WriteCloser) io.WriteCloser {
+	return c.b.outputWriter(mediatype, out)
+}
+
+// AddDependency records that the source dependent uses the source dep, so dependent is rebuilt when dep changes
+func (c *BuildContext) AddDependency(dep, dependent string) {
+	c.b.addDep(dep, dependent)
+}
+
+// RegisterOutput records a generated asset, relative to BuildDir, so it gets a content hash when hashing assets
+func (c *BuildContext) RegisterOutput(path string) {
+	c.b.registerOutput(path, outputCopy)
+}
@@ -0,0 +1,169 @@
+package builder
+
+import (
+	"encoding/xml"
+	"errors"
+	htemplate "html/template"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/toastate/toastfront/internal/tlogger"
+	"github.com/toastate/toastfront/pkg/config"
+)
+
+// SitemapFile is written at the top of the build directory when the sitemap is enabled
+const SitemapFile = "sitemap.xml"
+
+var ErrSitemapBaseURL = errors.New("the sitemap needs a base_url, its URLs must be absolute")
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	Xhtml   string       `xml:"xmlns:xhtml,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc        string           `xml:"loc"`
+	Alternates []sitemapAltLink `xml:"xhtml:link"`
+}
+
+type sitemapAltLink struct {
+	Rel      string `xml:"rel,attr"`
+	Hreflang string `xml:"hreflang,attr"`
+	Href     string `xml:"href,attr"`
+}
+
+// languages returns the languages built by the builder and its siblings, root language first
+func (b *Builder) languages() []string {
+	root := config.Config.ResolvedRootLanguage()
+	if b.languageMode == config.LanguageModeUnique || b.languageMode == "" {
+		return []string{root}
+	}
+
+	langs := []string{root}
+	for _, lg := range config.Config.Languages {
+		if lg != root {
+			langs = append(langs, lg)
+		}
+	}
+	return langs
+}
+
+// pageURL returns the URL of the page output at pagePath (relative to a language build directory) in the given language.
+// It is absolute when a base_url is configured. Index pages are linked by their directory.
+func (b *Builder) pageURL(lang, pagePath string) string {
+	p := filepath.ToSlash(pagePath)
+	if path.Base(p) == "index.html" {
+		p = strings.TrimSuffix(p, "index.html")
+	}
+
+	prefix := ""
+	switch b.languageMode {
+	case config.LanguageModeFolder:
+		prefix = "/" + lang
+	case config.LanguageModeSubfolder:
+		if lang != config.Config.ResolvedRootLanguage() {
+			prefix = "/" + lang
+		}
+	}
+
+	return strings.TrimSuffix(config.Config.BaseURL, "/") + prefix + "/" + p
+}
+
+// alternateLinks renders the <link rel="alternate" hreflang> tags of the page output at pagePath
+func (b *Builder) alternateLinks(pagePath string) htemplate.HTML {
+	langs := b.languages()
+	if len(langs) < 2 {
+		return ""
+	}
+
+	links := []string{}
+	for _, lg := range langs {
+		links = append(links, `<link rel="alternate" hreflang="`+htemplate.HTMLEscapeString(lg)+`" href="`+htemplate.HTMLEscapeString(b.pageURL(lg, pagePath))+`">`)
+	}
+	links = append(links, `<link rel="alternate" hreflang="x-default" href="`+htemplate.HTMLEscapeString(b.pageURL(langs[0], pagePath))+`">`)
+
+	return htemplate.HTML(strings.Join(links, "\n"))
+}
+
+// writeSitemap lists every page of every language in sitemap.xml, with the alternate languages of each page
+func (b *Builder) writeSitemap() error {
+	if config.Config.BaseURL == "" {
+		tlogger.Error("msg", "No base_url configured, the sitemap isn't written")
+		be := newBuildError("sitemap", SitemapFile, 0, ErrSitemapBaseURL)
+		b.diagnostics.error(be)
+		return be
+	}
+
+	builders := []*Builder{b}
+	for _, lg := range b.subBuilderLanguages() {
+		builders = append(builders, b.subBuilders[lg])
+	}
+
+	// Languages each page is available in
+	pageLangs := map[string][]string{}
+	for _, bd := range builders {
+		bd.outputsMu.Lock()
+		for p := range bd.pages {
+			pageLangs[p] = append(pageLangs[p], bd.currentLanguage)
+		}
+		bd.outputsMu.Unlock()
+	}
+
+	pages := make([]string, 0, len(pageLangs))
+	for p := range pageLangs {
+		pages = append(pages, p)
+	}
+	sort.Strings(pages)
+
+	set := sitemapURLSet{
+		Xmlns: "http://www.sitemaps.org/schemas/sitemap/0.9",
+		Xhtml: "http://www.w3.org/1999/xhtml",
+	}
+
+	for _, p := range pages {
+		langs := pageLangs[p]
+		sort.Slice(langs, func(i, j int) bool {
+			return langIndex(b.languages(), langs[i]) < langIndex(b.languages(), langs[j])
+		})
+
+		alternates := []sitemapAltLink{}
+		if len(langs) > 1 {
+			for _, lg := range langs {
+				alternates = append(alternates, sitemapAltLink{Rel: "alternate", Hreflang: lg, Href: b.pageURL(lg, p)})
+			}
+		}
+
+		for _, lg := range langs {
+			set.URLs = append(set.URLs, sitemapURL{Loc: b.pageURL(lg, p), Alternates: alternates})
+		}
+	}
+
+	out, err := xml.MarshalIndent(set, "", "  ")
+	if err != nil {
+		return err
+	}
+	out = append([]byte(xml.Header), out...)
+	out = append(out, '\n')
+
+	err = writeFile(b.output, SitemapFile, out)
+	if err != nil {
+		tlogger.Error("msg", "Failed to write sitemap", "path", b.siteDir, "err", err)
+		return err
+	}
+
+	tlogger.Info("msg", "Sitemap written", "pages", len(pages), "urls", len(set.URLs))
+	return nil
+}
+
+func langIndex(langs []string, lang string) int {
+	for i, lg := range langs {
+		if lg == lang {
+			return i
+		}
+	}
+	return len(langs)
+}
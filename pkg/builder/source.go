@@ -0,0 +1,64 @@
+package builder
+
+import (
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+)
+
+// sourceName converts a path relative to the source directory to an fs.FS name
+func sourceName(p string) string {
+	p = path.Clean(filepath.ToSlash(p))
+	if p == "" || p == "/" {
+		return "."
+	}
+	if p[0] == '/' {
+		return p[1:]
+	}
+	return p
+}
+
+func (b *Builder) readSource(p string) ([]byte, error) {
+	return fs.ReadFile(b.src, sourceName(p))
+}
+
+func (b *Builder) openSource(p string) (fs.File, error) {
+	return b.src.Open(sourceName(p))
+}
+
+func (b *Builder) statSource(p string) (fs.FileInfo, error) {
+	return fs.Stat(b.src, sourceName(p))
+}
+
+// walkSource walks the source tree from root like filepath.Walk, giving fn paths relative to the source directory
+func (b *Builder) walkSource(root string, fn filepath.WalkFunc) error {
+	return fs.WalkDir(b.src, sourceName(root), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return fn(filepath.FromSlash(p), nil, err)
+		}
+		info, err := d.Info()
+		return fn(filepath.FromSlash(p), info, err)
+	})
+}
+
+// outputName returns the output name of path, relative to the build directory of the language
+func (b *Builder) outputName(p string) string {
+	return path.Join(b.outputDir, filepath.ToSlash(p))
+}
+
+func (b *Builder) createOutput(p string) (io.WriteCloser, error) {
+	return b.output.Create(b.outputName(p))
+}
+
+func (b *Builder) writeOutput(p string, content []byte) error {
+	return writeFile(b.output, b.outputName(p), content)
+}
+
+func (b *Builder) readOutput(p string) ([]byte, error) {
+	return b.output.ReadFile(b.outputName(p))
+}
+
+func (b *Builder) removeOutput(p string) error {
+	return b.output.Remove(b.outputName(p))
+}
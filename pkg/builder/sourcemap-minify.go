@@ -0,0 +1,231 @@
+package builder
+
+import (
+	"bytes"
+	"sort"
+	"sync/atomic"
+
+	"github.com/tdewolff/parse/v2"
+	"github.com/tdewolff/parse/v2/css"
+	"github.com/tdewolff/parse/v2/js"
+)
+
+// Number of source tokens searched for each minified token, the minifier drops some and rewrites others
+const alignWindow = 16
+
+// mapToken is a token kept as is by the minifiers: identifiers, keywords, numbers and strings
+type mapToken struct {
+	text   []byte
+	offset int
+}
+
+// scanCSS returns the tokens of a stylesheet and the offsets of the lines starting after a top level rule or statement
+func scanCSS(content []byte) (tokens []mapToken, splits []int) {
+	// The lexer writes after the end of its input when there is room
+	l := css.NewLexer(parse.NewInputBytes(content[:len(content):len(content)]))
+
+	offset, depth := 0, 0
+	var last css.TokenType
+	for {
+		tt, text := l.Next()
+		if tt == css.ErrorToken {
+			return tokens, splits
+		}
+
+		switch tt {
+		case css.WhitespaceToken:
+			if k := bytes.LastIndexByte(text, '\n'); k >= 0 && depth == 0 && (last == css.RightBraceToken || last == css.SemicolonToken) {
+				splits = append(splits, offset+k+1)
+			}
+		case css.CommentToken:
+		default:
+			switch tt {
+			case css.LeftBraceToken, css.LeftParenthesisToken, css.LeftBracketToken, css.FunctionToken:
+				depth++
+			case css.RightBraceToken, css.RightParenthesisToken, css.RightBracketToken:
+				depth--
+			case css.IdentToken, css.AtKeywordToken, css.HashToken, css.StringToken, css.NumberToken, css.PercentageToken, css.DimensionToken, css.URLToken, css.CustomPropertyNameToken:
+				tokens = append(tokens, mapToken{text: text, offset: offset})
+			}
+			last = tt
+		}
+		offset += len(text)
+	}
+}
+
+// scanJS returns the tokens of a script and the offsets of the lines starting a top level statement after the end of another.
+// Lines whose first token could continue the previous statement aren't split, as the pieces are joined by line breaks.
+func scanJS(content []byte) (tokens []mapToken, splits []int) {
+	l := js.NewLexer(parse.NewInputBytes(content[:len(content):len(content)]))
+
+	offset, depth := 0, 0
+	split := -1
+	var last js.TokenType
+	for {
+		tt, text := l.Next()
+		if (tt == js.DivToken || tt == js.DivEqToken) && jsRegExpAllowed(last) {
+			tt, text = l.RegExp()
+		}
+		if tt == js.ErrorToken {
+			return tokens, splits
+		}
+
+		switch tt {
+		case js.LineTerminatorToken, js.CommentLineTerminatorToken:
+			if depth == 0 && (last == js.SemicolonToken || last == js.CloseBraceToken) {
+				split = offset + len(text)
+			}
+		case js.WhitespaceToken, js.CommentToken:
+		default:
+			if split >= 0 && jsStartsStatement(tt) {
+				splits = append(splits, split)
+			}
+			split = -1
+
+			switch {
+			case tt == js.OpenBraceToken || tt == js.OpenParenToken || tt == js.OpenBracketToken || tt == js.TemplateStartToken:
+				depth++
+			case tt == js.CloseBraceToken || tt == js.CloseParenToken || tt == js.CloseBracketToken || tt == js.TemplateEndToken:
+				depth--
+			case js.IsIdentifierName(tt) || js.IsNumeric(tt) || tt == js.StringToken || tt == js.TemplateToken || tt == js.RegExpToken:
+				tokens = append(tokens, mapToken{text: text, offset: offset})
+			}
+			last = tt
+		}
+		offset += len(text)
+	}
+}
+
+// jsRegExpAllowed reports whether a slash following the token last starts a regular expression rather than a division
+func jsRegExpAllowed(last js.TokenType) bool {
+	switch last {
+	case js.ErrorToken:
+		return true
+	case js.CloseParenToken, js.CloseBracketToken, js.CloseBraceToken, js.ThisToken, js.SuperToken, js.NullToken, js.TrueToken, js.FalseToken:
+		return false
+	}
+	return js.IsPunctuator(last) || js.IsReservedWord(last)
+}
+
+func jsStartsStatement(tt js.TokenType) bool {
+	switch tt {
+	case js.InToken, js.InstanceofToken, js.ElseToken, js.CatchToken, js.FinallyToken, js.FromToken, js.AsToken:
+		return false
+	}
+	return js.IsIdentifierName(tt)
+}
+
+// minifyMapped minifies content and maps the output back to the source lines of content. The content is cut
+// where top level rules or statements end, every piece is minified on its own (merged with the next one when
+// it can't be) and the tokens of the minified pieces are aligned with the source ones.
+// Stylesheets are output on a single line like the minifier does, scripts get a line per piece.
+func (b *Builder) minifyMapped(mediatype string, content []byte, lines []sourceLine) ([]byte, [][]mapSegment, error) {
+	scan := scanJS
+	separator := "\n"
+	if mediatype == MediaTypeCSS {
+		scan = scanCSS
+		separator = ""
+	}
+
+	tokens, splits := scan(content)
+	splits = append(splits, len(content))
+
+	lineStarts := []int{0}
+	for k, c := range content {
+		if c == '\n' {
+			lineStarts = append(lineStarts, k+1)
+		}
+	}
+
+	type mapping struct {
+		outOffset int
+		srcOffset int
+	}
+	mappings := []mapping{}
+	record := func(outOffset, srcOffset int) {
+		if n := len(mappings); n > 0 && mappings[n-1].outOffset == outOffset {
+			mappings[n-1].srcOffset = srcOffset
+			return
+		}
+		mappings = append(mappings, mapping{outOffset, srcOffset})
+	}
+
+	out := []byte{}
+	start := 0
+	for k, end := range splits {
+		if end <= start {
+			continue
+		}
+		minified, err := minifyBytes(mediatype, content[start:end])
+		if err != nil {
+			if k < len(splits)-1 {
+				// Not a complete rule or statement, it is minified with the next piece
+				continue
+			}
+			return nil, nil, err
+		}
+		minified = bytes.TrimSpace(minified)
+		if len(minified) == 0 {
+			start = end
+			continue
+		}
+
+		if len(out) > 0 {
+			out = append(out, separator...)
+		}
+		base := len(out)
+		out = append(out, minified...)
+
+		first := sort.Search(len(tokens), func(i int) bool { return tokens[i].offset >= start })
+		last := sort.Search(len(tokens), func(i int) bool { return tokens[i].offset >= end })
+		srcTokens := tokens[first:last]
+
+		srcStart := start + len(content[start:end]) - len(bytes.TrimLeft(content[start:end], " \t\r\n"))
+		record(base, srcStart)
+
+		minTokens, _ := scan(minified)
+		j := 0
+		for _, t := range minTokens {
+			for w := j; w < len(srcTokens) && w < j+alignWindow; w++ {
+				if bytes.Equal(srcTokens[w].text, t.text) {
+					record(base+t.offset, srcTokens[w].offset)
+					j = w + 1
+					break
+				}
+			}
+		}
+
+		start = end
+	}
+
+	if stat := b.minifyStats[mediatype]; stat != nil {
+		atomic.AddInt64(&stat.files, 1)
+		atomic.AddInt64(&stat.before, int64(len(content)))
+		atomic.AddInt64(&stat.after, int64(len(out)))
+	}
+
+	// Offsets to lines and columns
+	segments := [][]mapSegment{nil}
+	outLineStart := 0
+	m := 0
+	for k := 0; k <= len(out); k++ {
+		for m < len(mappings) && mappings[m].outOffset == k {
+			src := mappings[m].srcOffset
+			line := sort.Search(len(lineStarts), func(i int) bool { return lineStarts[i] > src }) - 1
+			if line < len(lines) && lines[line].File != "" {
+				segments[len(segments)-1] = append(segments[len(segments)-1], mapSegment{
+					col:    k - outLineStart,
+					origin: lines[line],
+					srcCol: src - lineStarts[line],
+				})
+			}
+			m++
+		}
+		if k < len(out) && out[k] == '\n' {
+			segments = append(segments, nil)
+			outLineStart = k + 1
+		}
+	}
+
+	return out, segments, nil
+}
@@ -0,0 +1,372 @@
+package builder
+
+import (
+	"bytes"
+	"io"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/toastate/toastfront/internal/helpers"
+	"github.com/toastate/toastfront/internal/tlogger"
+)
+
+// sourceLine is the origin of an output line, File is empty for generated lines
+type sourceLine struct {
+	File string
+	Line int
+}
+
+// mapSegment maps a column of an output line to a column of a source line
+type mapSegment struct {
+	col    int
+	origin sourceLine
+	srcCol int
+}
+
+// lineSegments maps the first column of every output line to the start of its source line
+func lineSegments(lines []sourceLine) [][]mapSegment {
+	out := make([][]mapSegment, len(lines))
+	for i, l := range lines {
+		if l.File != "" {
+			out[i] = []mapSegment{{origin: l}}
+		}
+	}
+	return out
+}
+
+// lineMapper accumulates an output and the origin of each of its lines
+type lineMapper struct {
+	out     []byte
+	lines   []sourceLine
+	midLine bool
+}
+
+// write appends text, origin returns the source of the k-th line of text.
+// When text starts in the middle of an output line, its first line keeps the origin already recorded.
+func (lm *lineMapper) write(text []byte, origin func(k int) sourceLine) {
+	k := 0
+	for _, c := range text {
+		if !lm.midLine {
+			lm.lines = append(lm.lines, origin(k))
+			lm.midLine = true
+		}
+		lm.out = append(lm.out, c)
+		if c == '\n' {
+			k++
+			lm.midLine = false
+		}
+	}
+}
+
+func (lm *lineMapper) writeSource(text []byte, file string, firstLine int) {
+	lm.write(text, func(k int) sourceLine {
+		return sourceLine{File: file, Line: firstLine + k}
+	})
+}
+
+func (lm *lineMapper) writeMapped(text []byte, lines []sourceLine) {
+	lm.write(text, func(k int) sourceLine {
+		if k < len(lines) {
+			return lines[k]
+		}
+		return sourceLine{}
+	})
+}
+
+// spliceImports replaces every match of re in content by the result of resolve,
+// like ReplaceAllFunc, while keeping track of the file and line every output line comes from.
+// resolve also receives the line of the match, for error reporting.
+func spliceImports(re *regexp.Regexp, path string, content []byte, resolve func(match []byte, line int) ([]byte, []sourceLine)) ([]byte, []sourceLine) {
+	lm := &lineMapper{}
+
+	prev := 0
+	line := 1
+	for _, loc := range re.FindAllIndex(content, -1) {
+		lm.writeSource(content[prev:loc[0]], path, line)
+		line += bytes.Count(content[prev:loc[0]], []byte{'\n'})
+
+		match := content[loc[0]:loc[1]]
+		matchLine := line + bytes.Count(match[:len(match)-len(bytes.TrimLeft(match, " \t\n"))], []byte{'\n'})
+
+		c, lines := resolve(match, matchLine)
+		lm.writeMapped(c, lines)
+		line += bytes.Count(content[loc[0]:loc[1]], []byte{'\n'})
+
+		prev = loc[1]
+	}
+	lm.writeSource(content[prev:], path, line)
+
+	return lm.out, lm.lines
+}
+
+// replaceMapped is regexp.ReplaceAllFunc keeping track of the origin of the content lines,
+// the lines of a replacement come from the line of the match
+func replaceMapped(re *regexp.Regexp, content []byte, lines []sourceLine, repl func([]byte) []byte) ([]byte, []sourceLine) {
+	lm := &lineMapper{}
+
+	prev := 0
+	line := 0
+	origin := func(k int) sourceLine {
+		if line+k < len(lines) {
+			return lines[line+k]
+		}
+		return sourceLine{}
+	}
+	for _, loc := range re.FindAllIndex(content, -1) {
+		lm.write(content[prev:loc[0]], origin)
+		line += bytes.Count(content[prev:loc[0]], []byte{'\n'})
+
+		matchOrigin := origin(0)
+		lm.write(repl(content[loc[0]:loc[1]]), func(int) sourceLine { return matchOrigin })
+		line += bytes.Count(content[loc[0]:loc[1]], []byte{'\n'})
+
+		prev = loc[1]
+	}
+	lm.write(content[prev:], origin)
+
+	return lm.out, lm.lines
+}
+
+// The markers of markLines, private use characters that don't show up in the sources
+const (
+	lineMarkStart = "\ue000"
+	lineMarkEnd   = "\ue001"
+)
+
+// markLines prefixes every line of a template source with a marker holding its index, unmarkLines uses them
+// to find the source line of every line of the template output. Lines starting inside an action,
+// or in whitespace trimmed by an action, aren't marked.
+func markLines(content []byte, leftDelim, rightDelim string) []byte {
+	actions := [][2]int{}
+	for p := 0; p < len(content); {
+		start := bytes.Index(content[p:], []byte(leftDelim))
+		if start < 0 {
+			break
+		}
+		start += p
+		end := bytes.Index(content[start+len(leftDelim):], []byte(rightDelim))
+		if end < 0 {
+			actions = append(actions, [2]int{start, len(content)})
+			break
+		}
+		end += start + len(leftDelim) + len(rightDelim)
+		actions = append(actions, [2]int{start, end})
+		p = end
+	}
+
+	isSpace := func(c byte) bool {
+		return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+	}
+	marked := func(pos int) bool {
+		for _, a := range actions {
+			if a[0] < pos && pos < a[1] {
+				return false
+			}
+		}
+
+		start, end := pos, pos
+		for start > 0 && isSpace(content[start-1]) {
+			start--
+		}
+		for end < len(content) && isSpace(content[end]) {
+			end++
+		}
+		trimLeft := bytes.HasPrefix(content[end:], []byte(leftDelim+"-")) && end+len(leftDelim)+1 < len(content) && isSpace(content[end+len(leftDelim)+1])
+		trimRight := bytes.HasSuffix(content[:start], []byte("-"+rightDelim)) && start-len(rightDelim)-2 >= 0 && isSpace(content[start-len(rightDelim)-2])
+		return !trimLeft && !trimRight
+	}
+
+	out := make([]byte, 0, len(content)+len(content)/8)
+	pos := 0
+	for i := 0; ; i++ {
+		if marked(pos) {
+			out = append(out, lineMarkStart+strconv.Itoa(i)+lineMarkEnd...)
+		}
+		end := bytes.IndexByte(content[pos:], '\n')
+		if end < 0 {
+			return append(out, content[pos:]...)
+		}
+		out = append(out, content[pos:pos+end+1]...)
+		pos += end + 1
+	}
+}
+
+// unmarkLines removes the markers of markLines from a template output and returns the origin of its lines,
+// lines without a marker come from the last marked line
+func unmarkLines(content []byte, lines []sourceLine) ([]byte, []sourceLine) {
+	out := make([]byte, 0, len(content))
+	outLines := []sourceLine{}
+
+	current := sourceLine{}
+	lineStart := true
+	for k := 0; k < len(content); {
+		if bytes.HasPrefix(content[k:], []byte(lineMarkStart)) {
+			end := bytes.Index(content[k:], []byte(lineMarkEnd))
+			if end > 0 {
+				idx, err := strconv.Atoi(string(content[k+len(lineMarkStart) : k+end]))
+				if err == nil && idx < len(lines) {
+					current = lines[idx]
+				}
+				k += end + len(lineMarkEnd)
+				continue
+			}
+		}
+
+		if lineStart {
+			outLines = append(outLines, current)
+			lineStart = false
+		}
+		out = append(out, content[k])
+		if content[k] == '\n' {
+			lineStart = true
+		}
+		k++
+	}
+
+	return out, outLines
+}
+
+type sourceMap struct {
+	Version        int      `json:"version"`
+	File           string   `json:"file"`
+	SourceRoot     string   `json:"sourceRoot,omitempty"`
+	Sources        []string `json:"sources"`
+	SourcesContent []string `json:"sourcesContent"`
+	Names          []string `json:"names"`
+	Mappings       string   `json:"mappings"`
+}
+
+const base64VLQChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+func writeVLQ(buf *strings.Builder, v int) {
+	vlq := v << 1
+	if v < 0 {
+		vlq = (-v)<<1 | 1
+	}
+	for {
+		digit := vlq & 31
+		vlq >>= 5
+		if vlq > 0 {
+			digit |= 32
+		}
+		buf.WriteByte(base64VLQChars[digit])
+		if vlq == 0 {
+			return
+		}
+	}
+}
+
+// newSourceMap builds a v3 source map from the segments of every output line
+func (b *Builder) newSourceMap(file string, segments [][]mapSegment) *sourceMap {
+	sm := &sourceMap{
+		Version:        3,
+		File:           file,
+		SourceRoot:     "/" + filepath.ToSlash(filepath.Base(b.srcDir)) + "/",
+		Sources:        []string{},
+		SourcesContent: []string{},
+		Names:          []string{},
+	}
+
+	sourceIndexes := map[string]int{}
+	sourceLengths := [][]int{}
+	mappings := &strings.Builder{}
+	prevSource, prevLine, prevCol := 0, 0, 0
+
+	for i, lineSegments := range segments {
+		if i > 0 {
+			mappings.WriteByte(';')
+		}
+
+		prevOutCol := 0
+		first := true
+		for _, seg := range lineSegments {
+			if seg.origin.File == "" {
+				continue
+			}
+
+			idx, ok := sourceIndexes[seg.origin.File]
+			if !ok {
+				idx = len(sm.Sources)
+				sourceIndexes[seg.origin.File] = idx
+				sm.Sources = append(sm.Sources, filepath.ToSlash(seg.origin.File))
+
+				content, err := b.readSource(seg.origin.File)
+				if err != nil {
+					tlogger.Warn("msg", "Can't read source map source", "file", seg.origin.File, "err", err)
+					b.diagnostics.warn("sourcemap", seg.origin.File, 0, "can't read source map source")
+				}
+				sm.SourcesContent = append(sm.SourcesContent, string(replaceWindowsCarriageReturn(content)))
+
+				lengths := []int{}
+				for _, l := range strings.Split(sm.SourcesContent[idx], "\n") {
+					lengths = append(lengths, len(l))
+				}
+				sourceLengths = append(sourceLengths, lengths)
+			}
+
+			// Columns of generated content, such as inlined vars, are past the end of the source line
+			if l := seg.origin.Line - 1; l < len(sourceLengths[idx]) && seg.srcCol > sourceLengths[idx][l] {
+				continue
+			}
+
+			if !first {
+				mappings.WriteByte(',')
+			}
+			first = false
+
+			writeVLQ(mappings, seg.col-prevOutCol)
+			writeVLQ(mappings, idx-prevSource)
+			writeVLQ(mappings, seg.origin.Line-1-prevLine)
+			writeVLQ(mappings, seg.srcCol-prevCol)
+			prevOutCol, prevSource, prevLine, prevCol = seg.col, idx, seg.origin.Line-1, seg.srcCol
+		}
+	}
+
+	sm.Mappings = mappings.String()
+	return sm
+}
+
+// writeWithSourceMap writes content to out followed by a sourceMappingURL comment,
+// and the matching source map next to it in the build directory. Minified outputs are mapped through the minifier.
+func (b *Builder) writeWithSourceMap(mediatype string, outPath string, out io.WriteCloser, content []byte, lines []sourceLine) error {
+	defer out.Close()
+
+	var segments [][]mapSegment
+	if b.shouldMinify(mediatype) {
+		var err error
+		content, segments, err = b.minifyMapped(mediatype, content, lines)
+		if err != nil {
+			return err
+		}
+	} else {
+		segments = lineSegments(lines)
+	}
+
+	mapName := path.Base(filepath.ToSlash(outPath)) + ".map"
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		content = append(content, '\n')
+	}
+	if mediatype == MediaTypeCSS {
+		content = append(content, []byte("/*# sourceMappingURL="+mapName+" */\n")...)
+	} else {
+		content = append(content, []byte("//# sourceMappingURL="+mapName+"\n")...)
+	}
+
+	_, err := out.Write(content)
+	if err != nil {
+		return err
+	}
+	err = out.Close()
+	if err != nil {
+		return err
+	}
+
+	sm, err := helpers.MarshalJson(b.newSourceMap(path.Base(filepath.ToSlash(outPath)), segments))
+	if err != nil {
+		return err
+	}
+	return b.writeOutput(outPath+".map", sm)
+}
@@ -0,0 +1,90 @@
+package builder
+
+import (
+	htemplate "html/template"
+	"io"
+	ttemplate "text/template"
+
+	"github.com/toastate/toastfront/internal/tlogger"
+	"github.com/toastate/toastfront/pkg/config"
+)
+
+// templatePart is the source of a template: a page, one of its layouts or a stylesheet
+type templatePart struct {
+	name    string
+	content []byte
+	lines   []sourceLine // Origin of every line of content
+}
+
+// pageFuncs returns the template functions available in the HTML pages, run is the builder processing the page
+func (b *Builder) pageFuncs(run *HTMLBuilder, pathOut string, data map[string]interface{}) map[string]interface{} {
+	funcs := b.templateFuncs(data)
+	funcs["toastfrontImport"] = run.importScope
+	funcs["alternateLinks"] = func() htemplate.HTML {
+		return b.alternateLinks(pathOut)
+	}
+	return funcs
+}
+
+// BuildEnv returns the env of the output at pagePath, relative to the language build directory.
+// An empty pagePath stands for the language home page.
+func (b *Builder) BuildEnv(pagePath string) BuildEnv {
+	env := BuildEnv{
+		Lang:           b.currentLanguage,
+		AvailableLangs: b.languages(),
+		AvaliableLangs: b.languages(),
+		RootLang:       config.Config.ResolvedRootLanguage(),
+		URLs:           map[string]string{},
+	}
+	for _, lg := range env.AvailableLangs {
+		env.URLs[lg] = b.pageURL(lg, pagePath)
+	}
+	return env
+}
+
+// addBuildEnv sets the toastfront var of data to the env of the output at pagePath,
+// warning when it replaces a var of the project
+func (b *Builder) addBuildEnv(builder, file string, data map[string]interface{}, pagePath string) {
+	if _, ok := data["toastfront"]; ok {
+		tlogger.Warn("builder", builder, "msg", "The toastfront var is reserved, the project var is replaced", "file", file)
+		b.diagnostics.warn(builder, file, 0, "the toastfront var is reserved, the one of the vars files is replaced by the build env")
+	}
+	data["toastfront"] = b.BuildEnv(pagePath).Vars()
+}
+
+// executeTemplate parses the parts in a single template set and executes the first one.
+// The blocks defined by a part override the ones of the parts before it.
+// text/template is used instead of html/template when unsafe vars are enabled.
+func executeTemplate(w io.Writer, leftDelim, rightDelim string, parts []templatePart, funcs map[string]interface{}, data interface{}) error {
+	if config.Config.UnsafeVars {
+		var t *ttemplate.Template
+		for _, part := range parts {
+			if t == nil {
+				t = ttemplate.New(part.name).Delims(leftDelim, rightDelim).Funcs(funcs)
+			} else {
+				t = t.New(part.name)
+			}
+
+			_, err := t.Parse(string(part.content))
+			if err != nil {
+				return err
+			}
+		}
+		return t.Lookup(parts[0].name).Execute(w, data)
+	}
+
+	var t *htemplate.Template
+	for _, part := range parts {
+		if t == nil {
+			t = htemplate.New(part.name).Delims(leftDelim, rightDelim).Funcs(funcs)
+		} else {
+			t = t.New(part.name)
+		}
+
+		_, err := t.Parse(string(part.content))
+		if err != nil {
+			return err
+		}
+	}
+	return t.Lookup(parts[0].name).Execute(w, data)
+}
@@ -0,0 +1,101 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DefaultEnvPrefix is the prefix of the environment variables exposed to the templates when env.prefixes isn't set
+const DefaultEnvPrefix = "TOASTFRONT_PUBLIC_"
+
+// EnvConfiguration selects the environment variables exposed to the templates and to toastfront.jsvars(),
+// the others never reach the build output
+type EnvConfiguration struct {
+	Prefixes []string `json:"prefixes,omitempty"` // Defaults to TOASTFRONT_PUBLIC_, an empty prefix exposes every variable
+	Allow    []string `json:"allow,omitempty"`    // Variables exposed whatever their name
+	Files    []string `json:"files,omitempty"`    // .env files read before the process environment, defaults to .env
+}
+
+// Exposes reports whether the environment variable name is available to the templates
+func (c EnvConfiguration) Exposes(name string) bool {
+	for _, v := range c.Allow {
+		if v == name {
+			return true
+		}
+	}
+
+	prefixes := c.Prefixes
+	if prefixes == nil {
+		prefixes = []string{DefaultEnvPrefix}
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolvedFiles returns the .env files to read, relative to the project directory
+func (c EnvConfiguration) ResolvedFiles() []string {
+	if c.Files == nil {
+		return []string{".env"}
+	}
+	return c.Files
+}
+
+// ReadEnvFile parses a .env file: KEY=value lines, optionally prefixed by export,
+// with single or double quoted values and # comments
+func ReadEnvFile(path string) (map[string]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	out := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		text = strings.TrimPrefix(text, "export ")
+
+		k := strings.IndexByte(text, '=')
+		if k <= 0 {
+			return nil, fmt.Errorf("%s:%d: expected KEY=value", path, line)
+		}
+		key := strings.TrimSpace(text[:k])
+		value := strings.TrimSpace(text[k+1:])
+
+		switch {
+		case strings.HasPrefix(value, `"`):
+			end := strings.LastIndexByte(value, '"')
+			if end == 0 {
+				return nil, fmt.Errorf("%s:%d: unterminated quoted value", path, line)
+			}
+			value, err = strconv.Unquote(value[:end+1])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid quoted value: %v", path, line, err)
+			}
+		case strings.HasPrefix(value, "'"):
+			end := strings.LastIndexByte(value, '\'')
+			if end == 0 {
+				return nil, fmt.Errorf("%s:%d: unterminated quoted value", path, line)
+			}
+			value = value[1:end]
+		default:
+			if c := strings.Index(value, " #"); c >= 0 {
+				value = strings.TrimSpace(value[:c])
+			}
+		}
+
+		out[key] = value
+	}
+
+	return out, scanner.Err()
+}
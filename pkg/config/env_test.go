@@ -0,0 +1,85 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeEnvFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), ".env")
+	err := os.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadEnvFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+	}{
+		{"plain", "KEY=value\nOTHER=1", map[string]string{"KEY": "value", "OTHER": "1"}},
+		{"spaces", "  KEY = value  \n", map[string]string{"KEY": "value"}},
+		{"empty value", "KEY=", map[string]string{"KEY": ""}},
+		{"equals in value", "URL=https://example.com/?a=b", map[string]string{"URL": "https://example.com/?a=b"}},
+		{"comments and blank lines", "# comment\n\n   # indented comment\nKEY=value\n", map[string]string{"KEY": "value"}},
+		{"inline comment", "KEY=value # comment", map[string]string{"KEY": "value"}},
+		{"hash without space", "KEY=value#hash", map[string]string{"KEY": "value#hash"}},
+		{"export", "export KEY=value", map[string]string{"KEY": "value"}},
+		{"double quotes", `KEY="a value # not a comment"`, map[string]string{"KEY": "a value # not a comment"}},
+		{"double quotes escapes", `KEY="line\nbreak \"quoted\""`, map[string]string{"KEY": "line\nbreak \"quoted\""}},
+		{"double quotes comment", `KEY="value" # comment`, map[string]string{"KEY": "value"}},
+		{"single quotes", `KEY='raw \n value'`, map[string]string{"KEY": `raw \n value`}},
+		{"single quotes comment", `KEY='value' # comment`, map[string]string{"KEY": "value"}},
+		{"exported quotes", `export KEY="value"`, map[string]string{"KEY": "value"}},
+		{"last wins", "KEY=a\nKEY=b", map[string]string{"KEY": "b"}},
+		{"crlf", "KEY=value\r\nOTHER=1\r\n", map[string]string{"KEY": "value", "OTHER": "1"}},
+	}
+
+	for _, tt := range tests {
+		got, err := ReadEnvFile(writeEnvFile(t, tt.content))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReadEnvFileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"missing equals", "KEY=value\nNOVALUE\n", ".env:2: expected KEY=value"},
+		{"missing key", "=value", ".env:1: expected KEY=value"},
+		{"unterminated double quotes", `KEY="value`, ".env:1: unterminated quoted value"},
+		{"unterminated single quotes", `KEY='value`, ".env:1: unterminated quoted value"},
+		{"invalid escape", `KEY="\q"`, ".env:1: invalid quoted value"},
+	}
+
+	for _, tt := range tests {
+		_, err := ReadEnvFile(writeEnvFile(t, tt.content))
+		if err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, err, tt.want)
+		}
+	}
+
+	_, err := ReadEnvFile(filepath.Join(t.TempDir(), "missing.env"))
+	if !os.IsNotExist(err) {
+		t.Errorf("missing file: got %v, want a not exist error", err)
+	}
+}
@@ -1,48 +1,53 @@
 package config
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
+
+	"github.com/toastate/toastfront/internal/tlogger"
 )
 
 var Config = DefaultConfiguration
 
-var DefaultConfiguration = &Configuration{
-	UnsafeVars:   false,
-	BuildDir:     "build",
-	SrcDir:       "src",
-	RootLanguage: "en",
-	Languages: []string{
-		"en",
-	},
-	ServeConfig: ServeConfiguration{
-		Redirect404: "",
-		Port:        8100,
-	},
-	LanguageMode: "unique", // Any of unique, subfolder, folder
-	HTMLDir:      "html",
-	VarsDir:      "html/vars",
-	BuilderConfig: map[string]map[string]string{
-		"css": {
-			"ext":       ".css",
-			"folder":    "css",
-			"vars_file": "config.json",
-		},
-		"vendor": {
-			"folder": "vendor",
-		},
-		"assets": {
-			"folder": "assets",
+var DefaultConfiguration = newDefaultConfiguration()
+
+func newDefaultConfiguration() *Configuration {
+	return &Configuration{
+		UnsafeVars:   false,
+		BuildDir:     "build",
+		SrcDir:       "src",
+		RootLanguage: "", // Defaults to the first language, see ResolvedRootLanguage
+		Languages: []string{
+			"en",
 		},
-		"html": {
-			"ext": ".html",
+		ServeConfig: ServeConfiguration{
+			Redirect404: "",
+			Port:        8100,
 		},
-		"javascript": {
-			"folder": "js",
-			"ext":    ".js",
+		LanguageMode: "", // Any of unique, subfolder, folder, see ResolvedLanguageMode when empty
+		HTMLDir:      "html",
+		VarsDir:      "html/vars",
+		BuilderConfig: map[string]map[string]string{
+			"css": {
+				"ext":       ".css",
+				"folder":    "css",
+				"vars_file": "config.json",
+			},
+			"vendor": {
+				"folder": "vendor",
+			},
+			"assets": {
+				"folder": "assets",
+			},
+			"html": {
+				"ext": ".html",
+			},
+			"javascript": {
+				"folder": "js",
+				"ext":    ".js",
+			},
 		},
-	},
+	}
 }
 
 type Configuration struct {
@@ -54,13 +59,74 @@ type Configuration struct {
 	RootLanguage  string                       `json:"root_language,omitempty"`
 	Languages     []string                     `json:"languages,omitempty"`
 	LanguageMode  string                       `json:"language_mode,omitempty"`
+	Fallbacks     map[string][]string          `json:"language_fallbacks,omitempty"` // Languages the vars of a language fall back to, in order
 	BuilderConfig map[string]map[string]string `json:"builder_config,omitempty"`
 	ServeConfig   ServeConfiguration           `json:"serve_config,omitempty"`
+	Minify        MinifyConfiguration          `json:"minify,omitempty"`
+	HashAssets    bool                         `json:"hash_assets,omitempty"`
+	SourceMaps    bool                         `json:"source_maps,omitempty"`
+	BaseURL       string                       `json:"base_url,omitempty"` // Public URL of the site, such as https://example.com
+	Sitemap       bool                         `json:"sitemap,omitempty"`
+	StrictI18n    bool                         `json:"strict_i18n,omitempty"` // Fail the builds on missing translations
+	Env           EnvConfiguration             `json:"env,omitempty"`
+}
+
+type MinifyConfiguration struct {
+	Enabled bool     `json:"enabled"`
+	Skip    []string `json:"skip,omitempty"` // Any of html, css, js
+}
+
+const (
+	LanguageModeUnique    = "unique"    // Only the root language is built, at the top of the build directory
+	LanguageModeSubfolder = "subfolder" // Root language at the top of the build directory, the others in build/<lang>
+	LanguageModeFolder    = "folder"    // Every language in build/<lang>, including the root one
+)
+
+// ResolvedRootLanguage returns the root language, defaulting to the first configured language
+func (c *Configuration) ResolvedRootLanguage() string {
+	if c.RootLanguage == "" && len(c.Languages) > 0 {
+		return c.Languages[0]
+	}
+	return c.RootLanguage
+}
+
+// ResolvedFallbacks returns the languages whose vars fill the ones missing from lang, by priority.
+// It defaults to the root language.
+func (c *Configuration) ResolvedFallbacks(lang string) []string {
+	chain, ok := c.Fallbacks[lang]
+	if !ok {
+		chain = []string{c.ResolvedRootLanguage()}
+	}
+
+	out := []string{}
+	for _, lg := range chain {
+		if lg != "" && lg != lang && !contains(out, lg) {
+			out = append(out, lg)
+		}
+	}
+	return out
+}
+
+// ResolvedLanguageMode returns the language mode, when it isn't set it is
+// unique for a single language, folder when no root language is set and subfolder otherwise
+func (c *Configuration) ResolvedLanguageMode() string {
+	if c.LanguageMode != "" {
+		return c.LanguageMode
+	}
+	if len(c.Languages) <= 1 {
+		return LanguageModeUnique
+	}
+	if c.RootLanguage == "" {
+		return LanguageModeFolder
+	}
+	return LanguageModeSubfolder
 }
 
 type ServeConfiguration struct {
 	Redirect404 string `json:"redirect_404"`
 	Port        int    `json:"port"`
+	Poll        bool   `json:"poll"`      // Poll the source directory instead of relying on file system events
+	InMemory    bool   `json:"in_memory"` // Keep the dev builds in memory, the build directory is left untouched
 }
 
 func Init(configpath string) error {
@@ -77,13 +143,17 @@ func Init(configpath string) error {
 		return nil
 	}
 
-	f, err := os.Open(configpath)
+	content, err := os.ReadFile(configpath)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
-	err = json.NewDecoder(f).Decode(Config)
+	issues, err := Decode(configpath, content, Config)
+	for _, issue := range issues {
+		if issue.Warning {
+			tlogger.Warn("msg", "Configuration warning", "file", configpath, "field", issue.Path, "warning", issue.Message)
+		}
+	}
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,417 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// BuilderConfigKeys lists the settings read by every builder in builder_config
+var BuilderConfigKeys = map[string][]string{
+	"css":        {"ext", "folder", "vars_file"},
+	"javascript": {"ext", "folder", "vars_file"},
+	"html":       {"ext", "vars_folder"},
+	"markdown":   {"ext", "layout"},
+	"vendor":     {"folder"},
+	"assets":     {"folder"},
+}
+
+var LanguageCodeRegexp = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+
+// Issue is a configuration problem, Path is the JSON path of the faulty field such as builder_config.css.ext
+type Issue struct {
+	Path    string
+	Message string
+	Warning bool // Warnings don't prevent the configuration from being used
+}
+
+func (i Issue) String() string {
+	if i.Path == "" {
+		return i.Message
+	}
+	return i.Path + ": " + i.Message
+}
+
+// ValidationError is returned when the configuration file has errors, it lists all of them
+type ValidationError struct {
+	File   string
+	Issues []Issue
+}
+
+func (e *ValidationError) Error() string {
+	lines := []string{"invalid configuration " + e.File + ":"}
+	for _, issue := range e.Issues {
+		if !issue.Warning {
+			lines = append(lines, "  "+issue.String())
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Decode reads a configuration file content into conf and validates it.
+// Every issue found is returned, err is a *ValidationError when any of them isn't a warning.
+func Decode(file string, content []byte, conf *Configuration) ([]Issue, error) {
+	issues, _ := decode(content, conf)
+	for _, issue := range issues {
+		if !issue.Warning {
+			return issues, &ValidationError{File: file, Issues: issues}
+		}
+	}
+	return issues, nil
+}
+
+// decode returns ok false when the content couldn't be decoded at all
+func decode(content []byte, conf *Configuration) (issues []Issue, ok bool) {
+	err := json.NewDecoder(bytes.NewReader(content)).Decode(conf)
+	if err != nil {
+		return []Issue{decodeIssue(content, err)}, false
+	}
+
+	raw := map[string]interface{}{}
+	if err := json.Unmarshal(content, &raw); err == nil {
+		issues = append(issues, unknownKeys("", raw, reflect.TypeOf(*conf))...)
+	}
+	issues = append(issues, conf.Validate()...)
+
+	return issues, true
+}
+
+func decodeIssue(content []byte, err error) Issue {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+
+	switch {
+	case errors.As(err, &syntaxErr):
+		line, col := offsetPosition(content, syntaxErr.Offset)
+		return Issue{Message: fmt.Sprintf("line %d column %d: %v", line, col, syntaxErr)}
+	case errors.As(err, &typeErr):
+		line, col := offsetPosition(content, typeErr.Offset)
+		return Issue{
+			Path:    typeErr.Field,
+			Message: fmt.Sprintf("expected %v, got a JSON %s (line %d column %d)", typeErr.Type, typeErr.Value, line, col),
+		}
+	}
+	return Issue{Message: err.Error()}
+}
+
+func offsetPosition(content []byte, offset int64) (line, col int) {
+	if offset > int64(len(content)) {
+		offset = int64(len(content))
+	}
+	before := content[:offset]
+	line = bytes.Count(before, []byte{'\n'}) + 1
+	col = int(offset) - bytes.LastIndexByte(before, '\n')
+	return line, col
+}
+
+// unknownKeys warns about the keys of raw matching no field of t
+func unknownKeys(prefix string, raw map[string]interface{}, t reflect.Type) []Issue {
+	fields := map[string]reflect.Type{}
+	names := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			fields[name] = t.Field(i).Type
+			names = append(names, name)
+		}
+	}
+
+	issues := []Issue{}
+	for _, key := range sortedKeys(raw) {
+		path := prefix + key
+
+		ft, ok := fields[key]
+		if !ok {
+			issues = append(issues, unknownKeyIssue(path, key, names))
+			continue
+		}
+
+		sub, isObject := raw[key].(map[string]interface{})
+		switch {
+		case !isObject:
+		case path == "builder_config":
+			issues = append(issues, unknownBuilderKeys(sub)...)
+		case ft.Kind() == reflect.Struct:
+			issues = append(issues, unknownKeys(path+".", sub, ft)...)
+		}
+	}
+	return issues
+}
+
+func unknownBuilderKeys(raw map[string]interface{}) []Issue {
+	builders := []string{}
+	for name := range BuilderConfigKeys {
+		builders = append(builders, name)
+	}
+
+	issues := []Issue{}
+	for _, name := range sortedKeys(raw) {
+		path := "builder_config." + name
+
+		keys, ok := BuilderConfigKeys[name]
+		if !ok {
+			issue := unknownKeyIssue(path, name, builders)
+			issue.Message = strings.Replace(issue.Message, "unknown key", "unknown builder", 1)
+			issues = append(issues, issue)
+			continue
+		}
+
+		settings, ok := raw[name].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for _, key := range sortedKeys(settings) {
+			if !contains(keys, key) {
+				issues = append(issues, unknownKeyIssue(path+"."+key, key, keys))
+			}
+		}
+	}
+	return issues
+}
+
+func unknownKeyIssue(path, key string, known []string) Issue {
+	msg := "unknown key, ignored"
+	if suggestion := closestKey(key, known); suggestion != "" {
+		msg += fmt.Sprintf(" (did you mean %q?)", suggestion)
+	}
+	return Issue{Path: path, Message: msg, Warning: true}
+}
+
+// closestKey returns the known key within two edits of key, or starting like it, if any
+func closestKey(key string, known []string) string {
+	best, bestDist := "", 3
+	for _, k := range known {
+		if strings.HasPrefix(k, key) || strings.HasPrefix(key, k) {
+			return k
+		}
+	}
+	for _, k := range known {
+		if d := editDistance(key, k); d < bestDist || (d == bestDist && k < best) {
+			best, bestDist = k, d
+		}
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(v int, others ...int) int {
+	for _, o := range others {
+		if o < v {
+			v = o
+		}
+	}
+	return v
+}
+
+func contains(list []string, v string) bool {
+	for _, e := range list {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Validate runs the checks that don't need the file system
+func (c *Configuration) Validate() []Issue {
+	issues := []Issue{}
+	errorf := func(path, format string, args ...interface{}) {
+		issues = append(issues, Issue{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	for i, lg := range c.Languages {
+		path := fmt.Sprintf("languages[%d]", i)
+		if !LanguageCodeRegexp.MatchString(lg) {
+			errorf(path, "%q is not a language code such as en or pt-BR", lg)
+		}
+		if contains(c.Languages[:i], lg) {
+			errorf(path, "%q is listed twice", lg)
+		}
+	}
+
+	if c.RootLanguage != "" && len(c.Languages) > 0 {
+		if !contains(c.Languages, c.RootLanguage) {
+			errorf("root_language", "%q is not part of languages %v", c.RootLanguage, c.Languages)
+		}
+	}
+
+	fallbackLangs := make([]string, 0, len(c.Fallbacks))
+	for lg := range c.Fallbacks {
+		fallbackLangs = append(fallbackLangs, lg)
+	}
+	sort.Strings(fallbackLangs)
+	for _, lg := range fallbackLangs {
+		path := "language_fallbacks." + lg
+		if !contains(c.Languages, lg) {
+			issues = append(issues, Issue{Path: path, Message: fmt.Sprintf("%q is not part of languages %v, its fallbacks are ignored", lg, c.Languages), Warning: true})
+		}
+		for i, fallback := range c.Fallbacks[lg] {
+			if !LanguageCodeRegexp.MatchString(fallback) {
+				errorf(fmt.Sprintf("%s[%d]", path, i), "%q is not a language code such as en or pt-BR", fallback)
+			} else if fallback == lg {
+				errorf(fmt.Sprintf("%s[%d]", path, i), "a language can't fall back to itself")
+			}
+		}
+	}
+
+	switch c.LanguageMode {
+	case "", LanguageModeUnique, LanguageModeSubfolder, LanguageModeFolder:
+	default:
+		errorf("language_mode", "%q is not one of %s, %s or %s", c.LanguageMode, LanguageModeUnique, LanguageModeSubfolder, LanguageModeFolder)
+	}
+	if c.ResolvedLanguageMode() == LanguageModeFolder && c.ResolvedRootLanguage() == "" {
+		errorf("root_language", "required by the %s language mode, to serve the site root", LanguageModeFolder)
+	}
+
+	if c.SrcDir == "" {
+		errorf("source_directory", "can't be empty")
+	}
+	if c.BuildDir == "" {
+		errorf("build_directory", "can't be empty")
+	}
+	if c.SrcDir != "" && c.BuildDir != "" && filepath.Clean(c.SrcDir) == filepath.Clean(c.BuildDir) {
+		errorf("build_directory", "can't be the source directory, it is removed on every build")
+	}
+
+	if !isInside(c.HTMLDir) {
+		errorf("html_directory", "%q must be a relative path inside the source directory", c.HTMLDir)
+	}
+	if !isInside(c.VarsDir) {
+		errorf("vars_directory", "%q must be a relative path inside the source directory", c.VarsDir)
+	}
+
+	for name, settings := range c.BuilderConfig {
+		if ext, ok := settings["ext"]; ok && !strings.HasPrefix(ext, ".") {
+			errorf("builder_config."+name+".ext", "%q must start with a dot", ext)
+		}
+		for _, key := range []string{"folder", "vars_folder"} {
+			if folder, ok := settings[key]; ok && !isInside(folder) {
+				errorf("builder_config."+name+"."+key, "%q must be a relative path inside the source directory", folder)
+			}
+		}
+	}
+
+	if c.BaseURL != "" {
+		u, err := url.Parse(c.BaseURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errorf("base_url", "%q must be an absolute http or https URL", c.BaseURL)
+		}
+	} else if c.Sitemap {
+		errorf("base_url", "required by the sitemap, its URLs must be absolute")
+	}
+
+	for i, prefix := range c.Env.Prefixes {
+		if prefix == "" {
+			issues = append(issues, Issue{Path: fmt.Sprintf("env.prefixes[%d]", i), Message: "an empty prefix exposes every environment variable, including secrets, to the build output", Warning: true})
+		}
+	}
+
+	if c.ServeConfig.Port < 0 || c.ServeConfig.Port > 65535 {
+		errorf("serve_config.port", "%d is not a valid port", c.ServeConfig.Port)
+	}
+
+	for i, t := range c.Minify.Skip {
+		if t != "html" && t != "css" && t != "js" {
+			errorf(fmt.Sprintf("minify.skip[%d]", i), "%q is not one of html, css or js", t)
+		}
+	}
+
+	return issues
+}
+
+// CheckSourceDir checks the configured directories against the content of the source directory
+func (c *Configuration) CheckSourceDir(srcDir string) []Issue {
+	info, err := os.Stat(srcDir)
+	if err != nil || !info.IsDir() {
+		return []Issue{{Path: "source_directory", Message: fmt.Sprintf("%q is not a directory", srcDir)}}
+	}
+
+	issues := []Issue{}
+	if c.HTMLDir != "" && isInside(c.HTMLDir) {
+		info, err := os.Stat(filepath.Join(srcDir, c.HTMLDir))
+		if err != nil || !info.IsDir() {
+			issues = append(issues, Issue{Path: "html_directory", Message: fmt.Sprintf("%q doesn't exist in %s", c.HTMLDir, srcDir)})
+		}
+	}
+	if c.VarsDir != "" && isInside(c.VarsDir) {
+		_, err := os.Stat(filepath.Join(srcDir, c.VarsDir))
+		if err != nil {
+			issues = append(issues, Issue{Path: "vars_directory", Message: fmt.Sprintf("%q doesn't exist in %s, no vars are loaded", c.VarsDir, srcDir), Warning: true})
+		}
+	}
+	return issues
+}
+
+// isInside reports whether p is a relative path that doesn't leave its parent directory
+func isInside(p string) bool {
+	if p == "" {
+		return true
+	}
+	if filepath.IsAbs(p) || strings.HasPrefix(p, "/") {
+		return false
+	}
+	clean := filepath.ToSlash(filepath.Clean(p))
+	return clean != ".." && !strings.HasPrefix(clean, "../")
+}
+
+// Check loads the configuration file like Init, without applying it, and checks it against the source directory.
+// The source directory defaults to the configured one.
+func Check(configpath, srcDir string) ([]Issue, error) {
+	if configpath == "" {
+		configpath = "toastfront.json"
+	}
+
+	content, err := os.ReadFile(configpath)
+	if err != nil {
+		return nil, fmt.Errorf("could not read configuration file %s: %v", configpath, err)
+	}
+
+	conf := newDefaultConfiguration()
+	issues, ok := decode(content, conf)
+	if !ok {
+		return issues, nil
+	}
+
+	if srcDir == "" {
+		srcDir = conf.SrcDir
+	}
+	issues = append(issues, conf.CheckSourceDir(srcDir)...)
+
+	return issues, nil
+}
@@ -0,0 +1,231 @@
+package scaffold
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/toastate/toastfront/internal/tlogger"
+	"github.com/toastate/toastfront/pkg/config"
+)
+
+// Options describes the project generated by Create
+type Options struct {
+	Dir          string   // Project directory, created if needed
+	Languages    []string // Defaults to the root language alone
+	RootLanguage string   // Defaults to the first language
+	HTMLDir      string   // Defaults to html
+}
+
+// Create writes a project skeleton: toastfront.json and a src directory with pages, includes, vars, CSS and JS.
+// Nothing is written when any of the files already exists.
+func Create(opts Options) error {
+	if opts.Dir == "" {
+		opts.Dir = "."
+	}
+	if opts.HTMLDir == "" {
+		opts.HTMLDir = config.DefaultConfiguration.HTMLDir
+	}
+	opts.HTMLDir = strings.Trim(filepath.ToSlash(opts.HTMLDir), "/")
+	if len(opts.Languages) == 0 {
+		opts.Languages = []string{opts.RootLanguage}
+		if opts.RootLanguage == "" {
+			opts.Languages = config.DefaultConfiguration.Languages
+		}
+	}
+	if opts.RootLanguage == "" {
+		opts.RootLanguage = opts.Languages[0]
+	}
+
+	found := false
+	for _, lg := range opts.Languages {
+		if lg == opts.RootLanguage {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("root language %q is not part of the languages %v", opts.RootLanguage, opts.Languages)
+	}
+
+	files, err := projectFiles(opts)
+	if err != nil {
+		return err
+	}
+
+	paths := make([]string, 0, len(files))
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	existing := []string{}
+	for _, p := range paths {
+		_, err := os.Stat(filepath.Join(opts.Dir, p))
+		if err == nil {
+			existing = append(existing, p)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if len(existing) > 0 {
+		return fmt.Errorf("refusing to overwrite existing files: %s", strings.Join(existing, ", "))
+	}
+
+	for _, p := range paths {
+		fullPath := filepath.Join(opts.Dir, filepath.FromSlash(p))
+
+		err := os.MkdirAll(filepath.Dir(fullPath), 0755)
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(fullPath, []byte(files[p]), 0644)
+		if err != nil {
+			tlogger.Error("msg", "Failed to write project file", "path", fullPath, "err", err)
+			return err
+		}
+		tlogger.Debug("msg", "Project file created", "path", fullPath)
+	}
+
+	tlogger.Info("msg", "Project created", "path", opts.Dir, "languages", strings.Join(opts.Languages, ","))
+	return nil
+}
+
+// projectFiles returns the content of every generated file, indexed by its slash separated path
+func projectFiles(opts Options) (map[string]string, error) {
+	conf, err := projectConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	src := config.DefaultConfiguration.SrcDir
+	htmlDir := src + "/" + opts.HTMLDir
+	varsDir := htmlDir + "/vars"
+
+	files := map[string]string{
+		"toastfront.json": conf,
+
+		htmlDir + "/index.html":            indexHTML,
+		htmlDir + "/includes/head.html":    headHTML,
+		htmlDir + "/includes/header.html":  headerHTML,
+		htmlDir + "/includes/footer.html":  footerHTML,
+		varsDir + "/common.json":           "{\n    \"site_name\": \"Toastfront\"\n}\n",
+		varsDir + "/index/common.json":     "{\n    \"page\": \"index\"\n}\n",
+		src + "/css/config.json":           cssVars,
+		src + "/css/main.css":              mainCSS,
+		src + "/css/includes/base.css":     baseCSS,
+		src + "/js/vars.json":              "{\n    \"debug\": false\n}\n",
+		src + "/js/main.js":                mainJS,
+		src + "/js/includes/navigation.js": navigationJS,
+	}
+
+	for _, lg := range opts.Languages {
+		files[varsDir+"/lang-"+lg+".json"] = "{\n    \"title\": \"Toastfront - " + strings.ToUpper(lg) + "\"\n}\n"
+		files[varsDir+"/index/lang-"+lg+".json"] = "{\n    \"heading\": \"Welcome\"\n}\n"
+	}
+
+	return files, nil
+}
+
+func projectConfig(opts Options) (string, error) {
+	builderConfig := map[string]map[string]string{}
+	for name, values := range config.DefaultConfiguration.BuilderConfig {
+		builderConfig[name] = map[string]string{}
+		for k, v := range values {
+			builderConfig[name][k] = v
+		}
+	}
+
+	conf := &config.Configuration{
+		BuildDir:      config.DefaultConfiguration.BuildDir,
+		SrcDir:        config.DefaultConfiguration.SrcDir,
+		HTMLDir:       opts.HTMLDir,
+		VarsDir:       opts.HTMLDir + "/vars",
+		RootLanguage:  opts.RootLanguage,
+		Languages:     opts.Languages,
+		ServeConfig:   config.DefaultConfiguration.ServeConfig,
+		BuilderConfig: builderConfig,
+	}
+
+	b, err := json.MarshalIndent(conf, "", "    ")
+	if err != nil {
+		return "", err
+	}
+	return string(b) + "\n", nil
+}
+
+const indexHTML = `<!DOCTYPE html>
+<html lang="<!--#.toastfront.lang-->">
+  <head>
+    <!--#import /includes/head.html-->
+  </head>
+
+  <body>
+    <!--#import /includes/header.html-->
+
+    <main>
+      <h1><!--#.heading--></h1>
+    </main>
+
+    <!--#import /includes/footer.html-->
+  </body>
+</html>
+`
+
+const headHTML = `<meta charset="utf-8" />
+<meta name="viewport" content="width=device-width, initial-scale=1" />
+<title><!--#.title--></title>
+
+<link rel="stylesheet" type="text/css" href="/css/main.css">
+`
+
+const headerHTML = `<header>
+  <a href="<!--#index .toastfront.urls .toastfront.lang-->"><!--#.site_name--></a>
+  <!--#if gt (len .toastfront.languages) 1 -->
+  <nav>
+    <!--#range $lang, $url := .toastfront.urls--><a href="<!--#$url-->" hreflang="<!--#$lang-->"><!--#upper $lang--></a> <!--#end-->
+  </nav>
+  <!--#end-->
+</header>
+`
+
+const footerHTML = `<footer>
+</footer>
+
+<script src="/js/main.js"></script>
+`
+
+const cssVars = `{
+    "primary": "#0148ff",
+    "text_color": "#1a1a1a"
+}
+`
+
+const mainCSS = `@import "local://includes/base.css";
+
+header {
+    background-color: "{{.primary}}";
+}
+`
+
+const baseCSS = `body {
+    margin: 0;
+    color: "{{.text_color}}";
+    font-family: sans-serif;
+}
+`
+
+const mainJS = `import "local://includes/navigation.js";
+
+var vars = toastfront.jsvars();
+if (vars.debug) {
+    console.log("Debug mode");
+}
+`
+
+const navigationJS = `document.addEventListener("DOMContentLoaded", function () {
+    console.log("Ready");
+});
+`
@@ -1,14 +1,19 @@
 package server
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"mime"
 	"net/http"
 	"os"
 	"path"
-	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -16,6 +21,7 @@ import (
 	"github.com/toastate/toastfront/internal/tlogger"
 	"github.com/toastate/toastfront/internal/watcher"
 	"github.com/toastate/toastfront/pkg/builder"
+	"github.com/toastate/toastfront/pkg/config"
 
 	_ "embed"
 )
@@ -42,10 +48,91 @@ type Server struct {
 	override404  string
 	reloadBroker *Broker
 	buildtool    *builder.Builder
+	buildOpts    *builder.BuilderOpts
+	pollInterval time.Duration // Source changes are polled instead of watched when set
+
+	memory *builder.MemoryOutput // Builds are kept in memory instead of the build directory when set
+	site   atomic.Value          // fs.FS served, the last successful build when building in memory
+
+	buildErrMu sync.Mutex
+	buildErr   *builder.BuildError // Last build failure, shown to the pages opened before the next successful build
+
+	languageMode string
+	rootLanguage string
+	languages    map[string]struct{}
 }
 
+// ReloadMessage is sent to the pages over the livereload websocket
+type ReloadMessage struct {
+	Type  string              `json:"type"`            // reload, css or error
+	Path  string              `json:"path,omitempty"`  // URL path of the stylesheet to swap for css messages, language prefix included
+	Error *builder.BuildError `json:"error,omitempty"` // Build failure to display for error messages
+}
+
+const (
+	ReloadTypeFull  = "reload"
+	ReloadTypeCSS   = "css"
+	ReloadTypeError = "error"
+)
+
 func (s *Server) TriggerReload() {
-	s.reloadBroker.Publish(struct{}{})
+	s.reloadBroker.Publish([]ReloadMessage{{Type: ReloadTypeFull}})
+}
+
+// TriggerError displays the build error in the pages until the next successful build
+func (s *Server) TriggerError(err error) {
+	be := &builder.BuildError{}
+	if !errors.As(err, &be) {
+		be = &builder.BuildError{Message: err.Error()}
+	}
+
+	s.buildErrMu.Lock()
+	s.buildErr = be
+	s.buildErrMu.Unlock()
+
+	s.reloadBroker.Publish([]ReloadMessage{{Type: ReloadTypeError, Error: be}})
+}
+
+func (s *Server) lastBuildError() *builder.BuildError {
+	s.buildErrMu.Lock()
+	defer s.buildErrMu.Unlock()
+	return s.buildErr
+}
+
+func (s *Server) clearBuildError() {
+	s.buildErrMu.Lock()
+	s.buildErr = nil
+	s.buildErrMu.Unlock()
+}
+
+// TriggerCSSReload swaps the given stylesheets, relative to the language root, in the pages without reloading them.
+// Pages linking none of them are left untouched.
+func (s *Server) TriggerCSSReload(paths []string) {
+	msgs := make([]ReloadMessage, 0, len(paths))
+	for _, p := range paths {
+		for _, u := range s.languageURLs(p) {
+			msgs = append(msgs, ReloadMessage{Type: ReloadTypeCSS, Path: u})
+		}
+	}
+	s.reloadBroker.Publish(msgs)
+}
+
+// languageURLs returns the URL paths serving p, relative to the language root, in every language
+func (s *Server) languageURLs(p string) []string {
+	if s.languageMode == config.LanguageModeUnique {
+		return []string{p}
+	}
+
+	// Paths without a language are served from the root language in both modes
+	out := []string{p}
+	for lg := range s.languages {
+		if lg == s.rootLanguage && s.languageMode == config.LanguageModeSubfolder {
+			continue
+		}
+		out = append(out, "/"+lg+p)
+	}
+	sort.Strings(out[1:])
+	return out
 }
 
 func NewServer(sourceDir, buildDir, rootDir string, port string, override404 string) *Server {
@@ -57,53 +144,125 @@ func NewServer(sourceDir, buildDir, rootDir string, port string, override404 str
 		override404:  override404,
 		reloadBroker: newBroker(),
 		buildtool:    builder.NewBuilder(sourceDir, buildDir, rootDir),
+		languageMode: config.Config.ResolvedLanguageMode(),
+		rootLanguage: config.Config.ResolvedRootLanguage(),
+		languages:    map[string]struct{}{},
+	}
+
+	for _, lg := range config.Config.Languages {
+		s.languages[lg] = struct{}{}
 	}
 
 	return s
 }
 
+// SetBuilderOpts sets the options used for the builds run by the server
+func (s *Server) SetBuilderOpts(opts *builder.BuilderOpts) {
+	s.buildOpts = opts
+}
+
+// SetPollInterval makes the server poll the source directory for changes, for filesystems without change events
+func (s *Server) SetPollInterval(interval time.Duration) {
+	s.pollInterval = interval
+}
+
+// SetInMemory keeps the builds in memory instead of writing them to the build directory.
+// The pages are served from the last successful build, they never see a half built site.
+func (s *Server) SetInMemory(enabled bool) {
+	s.memory = nil
+	if enabled {
+		s.memory = builder.NewMemoryOutput()
+	}
+}
+
+// publish swaps the served site for the current in memory build
+func (s *Server) publish() {
+	if s.memory != nil {
+		s.site.Store(s.memory.Snapshot())
+	}
+}
+
 func (s *Server) Start(withBuilder bool) error {
+	if withBuilder && s.memory != nil {
+		err := s.buildtool.SetOutput(s.memory)
+		if err != nil {
+			return err
+		}
+	} else {
+		s.memory = nil
+		s.site.Store(os.DirFS(s.buildDir))
+	}
+
 	if withBuilder {
 		err := s.buildtool.Init()
 		if err != nil {
 			return err
 		}
 
+		go s.reloadBroker.Start()
+
 		buildStart := time.Now()
-		err = s.buildtool.Build()
+		err = s.buildtool.Build(s.buildOpts)
 		estBuildTime := time.Since(buildStart)
 		estBuildTime *= 2
 		if estBuildTime > time.Millisecond*500 {
 			estBuildTime = time.Millisecond * 500
 		}
+		// Published even on failure, there is no previous build and the pages must load to display the error
+		s.publish()
 		if err != nil {
-			os.Exit(1)
+			// Keep serving, the error is displayed in the pages until it is fixed
+			s.TriggerError(err)
 		}
 
-		updates := watcher.StartWatcher(s.sourceDir)
-
-		go s.reloadBroker.Start()
+		var updates <-chan string
+		// The .env files are usually outside of the source directory
+		if s.pollInterval > 0 {
+			updates = watcher.Merge(watcher.StartPollingWatcher(s.sourceDir, s.pollInterval), watcher.StartFilesPollingWatcher(s.buildtool.EnvFiles(), s.pollInterval))
+		} else {
+			updates = watcher.Merge(watcher.StartWatcher(s.sourceDir), watcher.StartFilesWatcher(s.buildtool.EnvFiles()))
+		}
 
 		go func() {
 			for {
-				<-updates
+				changed := map[string]struct{}{<-updates: {}}
 			rootFor:
 				for {
 					select {
-					case <-updates:
+					case p := <-updates:
+						changed[p] = struct{}{}
 						continue
 					case <-time.After(time.Millisecond * 500):
 						break rootFor
 					}
 				}
-				s.buildtool.Build()
-				s.TriggerReload()
+
+				paths := make([]string, 0, len(changed))
+				for p := range changed {
+					paths = append(paths, p)
+				}
+				err := s.buildtool.BuildChanged(paths)
+				if err != nil {
+					s.TriggerError(err)
+					continue
+				}
+				s.publish()
+
+				// A full reload brings the page back in sync after a failed build
+				if s.lastBuildError() != nil {
+					s.clearBuildError()
+					s.TriggerReload()
+				} else if stylesheets, ok := s.buildtool.StylesheetOutputs(paths); ok {
+					s.TriggerCSSReload(stylesheets)
+				} else {
+					s.TriggerReload()
+				}
 			}
 		}()
 	}
 
 	r := mux.NewRouter()
-	r.PathPrefix("/").HandlerFunc(s.fileServer(s.buildDir, s.override404))
+	r.PathPrefix("/").HandlerFunc(s.fileServer(s.override404))
 
 	// We use println here so the address can be copied or opened directly from the terminal
 	fmt.Println("Listening on http://localhost:" + s.port)
@@ -111,7 +270,7 @@ func (s *Server) Start(withBuilder bool) error {
 	return http.ListenAndServe(":"+s.port, r)
 }
 
-func (s *Server) fileServer(dir string, override404 string) func(http.ResponseWriter, *http.Request) {
+func (s *Server) fileServer(override404 string) func(http.ResponseWriter, *http.Request) {
 	if override404 != "" && !strings.HasPrefix(override404, "/") {
 		override404 = "/" + override404
 	}
@@ -121,6 +280,20 @@ func (s *Server) fileServer(dir string, override404 string) func(http.ResponseWr
 			s.livereloadHandler(w, r)
 			return
 		}
+
+		if s.languageMode == config.LanguageModeFolder && (r.URL.Path == "/" || r.URL.Path == "") {
+			http.Redirect(w, r, "/"+s.rootLanguage+"/", http.StatusFound)
+			return
+		}
+
+		// Loaded once, so the request is served from a single build
+		site := s.site.Load().(fs.FS)
+
+		notFoundPage := override404
+		if lg := s.pathLanguage(r.URL.Path); lg != "" && override404 != "" {
+			notFoundPage = "/" + lg + override404
+		}
+
 	begin:
 		upath := r.URL.Path
 		if !strings.HasPrefix(upath, "/") {
@@ -128,15 +301,19 @@ func (s *Server) fileServer(dir string, override404 string) func(http.ResponseWr
 			r.URL.Path = upath
 		}
 
-		const indexPage = "index.html"
+		// Every language lives in its own folder, paths without a language are served from the root language
+		// unless they exist at the top of the build directory (sitemap.xml)
+		if s.languageMode == config.LanguageModeFolder && s.pathLanguage(upath) == "" {
+			if info, err := fs.Stat(site, siteName(upath)); err != nil || info.IsDir() {
+				upath = "/" + s.rootLanguage + upath
+			}
+		}
 
-		fullName := filepath.Join(dir, filepath.FromSlash(path.Clean(upath)))
+		const indexPage = "index.html"
 
-		if fullName[len(fullName)-1] == '/' {
-			fullName = filepath.Join(fullName, indexPage)
-		}
+		fullName := siteName(upath)
 
-		info, err := os.Stat(fullName)
+		info, err := fs.Stat(site, fullName)
 
 		valid := false
 		if err != nil || info.IsDir() {
@@ -146,7 +323,7 @@ func (s *Server) fileServer(dir string, override404 string) func(http.ResponseWr
 				return
 			}
 
-			info, err = os.Stat(fullName + ".html")
+			info, err = fs.Stat(site, fullName+".html")
 			if err != nil || info.IsDir() {
 				if err != nil && !os.IsNotExist(err) {
 					w.WriteHeader(500)
@@ -154,7 +331,7 @@ func (s *Server) fileServer(dir string, override404 string) func(http.ResponseWr
 					return
 				}
 
-				info, err := os.Stat(filepath.Join(fullName, indexPage))
+				info, err := fs.Stat(site, path.Join(fullName, indexPage))
 				if err != nil || info.IsDir() {
 					if err != nil && !os.IsNotExist(err) {
 						w.WriteHeader(500)
@@ -162,7 +339,7 @@ func (s *Server) fileServer(dir string, override404 string) func(http.ResponseWr
 						return
 					}
 				} else {
-					fullName = filepath.Join(fullName, indexPage)
+					fullName = path.Join(fullName, indexPage)
 					valid = true
 				}
 			} else {
@@ -174,8 +351,8 @@ func (s *Server) fileServer(dir string, override404 string) func(http.ResponseWr
 		}
 
 		if !valid {
-			if override404 != "" && r.URL.Path != override404 {
-				r.URL.Path = override404
+			if notFoundPage != "" && r.URL.Path != notFoundPage {
+				r.URL.Path = notFoundPage
 				goto begin
 			}
 			w.WriteHeader(404)
@@ -183,24 +360,22 @@ func (s *Server) fileServer(dir string, override404 string) func(http.ResponseWr
 			return
 		}
 
-		content, err := os.Open(fullName)
+		f, err := site.Open(fullName)
 		if err != nil {
 			w.WriteHeader(500)
 			w.Write([]byte("Internal error: can't open file"))
+			return
 		}
+		defer f.Close()
 
-		ctype := mime.TypeByExtension(filepath.Ext(fullName))
+		var content io.Reader = f
+		ctype := mime.TypeByExtension(path.Ext(fullName))
 		if ctype == "" {
 			// read a chunk to decide between utf-8 text and binary
 			var buf [512]byte
-			n, _ := io.ReadFull(content, buf[:])
+			n, _ := io.ReadFull(f, buf[:])
 			ctype = http.DetectContentType(buf[:n])
-			_, err := content.Seek(0, io.SeekStart) // rewind to output whole file
-			if err != nil {
-				w.WriteHeader(500)
-				w.Write([]byte("Internal error: can't seek file: " + err.Error()))
-				return
-			}
+			content = io.MultiReader(bytes.NewReader(buf[:n]), f)
 		}
 		w.Header().Set("Content-Type", ctype)
 		io.Copy(w, content)
@@ -213,6 +388,31 @@ func (s *Server) fileServer(dir string, override404 string) func(http.ResponseWr
 	}
 }
 
+// siteName converts an URL path to a name of the served fs.FS
+func siteName(upath string) string {
+	name := strings.TrimPrefix(path.Clean(upath), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// pathLanguage returns the language prefixing upath when languages are built in their own folders
+func (s *Server) pathLanguage(upath string) string {
+	if s.languageMode == config.LanguageModeUnique {
+		return ""
+	}
+
+	first := strings.SplitN(strings.TrimPrefix(upath, "/"), "/", 2)[0]
+	if s.languageMode == config.LanguageModeSubfolder && first == s.rootLanguage {
+		return ""
+	}
+	if _, ok := s.languages[first]; ok {
+		return first
+	}
+	return ""
+}
+
 func (s *Server) livereloadHandler(w http.ResponseWriter, r *http.Request) {
 	tlogger.Debug("msg", "WS Established")
 
@@ -223,11 +423,42 @@ func (s *Server) livereloadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer c.Close()
+
 	waitCh := s.reloadBroker.Subscribe()
-	<-waitCh
-	err = c.WriteMessage(websocket.TextMessage, []byte("reload"))
-	if err != nil {
-		tlogger.Warn("msg", "Reload socket error", "error", err)
+	defer s.reloadBroker.Unsubscribe(waitCh)
+
+	// The page never sends anything, reading is only used to detect it went away
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	if be := s.lastBuildError(); be != nil {
+		err = c.WriteJSON(ReloadMessage{Type: ReloadTypeError, Error: be})
+		if err != nil {
+			tlogger.Warn("msg", "Reload socket error", "error", err)
+			return
+		}
+	}
+
+	for {
+		select {
+		case <-closed:
+			return
+		case msg := <-waitCh:
+			msgs, _ := msg.([]ReloadMessage)
+			for _, m := range msgs {
+				err = c.WriteJSON(m)
+				if err != nil {
+					tlogger.Warn("msg", "Reload socket error", "error", err)
+					return
+				}
+			}
+		}
 	}
-	s.reloadBroker.Unsubscribe(waitCh)
 }